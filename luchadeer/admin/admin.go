@@ -0,0 +1,435 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package admin
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"errors"
+	"luchadeer/categories"
+	"luchadeer/client"
+	"luchadeer/db"
+	"luchadeer/flags"
+	"luchadeer/tasks"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// results per page for the listing endpoints
+const pageSize = 100
+
+func Init() {
+	http.HandleFunc("/admin/backfill", backfillHandler)
+	http.HandleFunc("/admin/video_changes", videoChangesHandler)
+	http.HandleFunc("/admin/categories", categoriesHandler)
+	http.HandleFunc("/admin/flags", flagsHandler)
+	http.HandleFunc("/admin/pushes", pushesHandler)
+	http.HandleFunc("/admin/devices", devicesHandler)
+	http.HandleFunc("/admin/prune_devices", pruneDevicesHandler)
+}
+
+// get reports backfill progress. post with action=start, restart or stop.
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	var state *db.BackfillState
+	var err error
+
+	switch r.Method {
+	case "GET":
+		state, err = db.GetBackfillState(context)
+	case "POST":
+		switch r.FormValue("action") {
+		case "start":
+			state, err = tasks.StartVideoBackfill(context, false)
+		case "restart":
+			state, err = tasks.StartVideoBackfill(context, true)
+		case "stop":
+			state, err = tasks.StopVideoBackfill(context)
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		context.Errorf("backfill %v: %v", r.FormValue("action"), err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(context, w, state)
+}
+
+type videoChangesResponse struct {
+	Revisions []db.VideoRevision `json:"revisions"`
+	Cursor    string             `json:"cursor,omitempty"`
+}
+
+// changes to stored videos, newest first. video_id limits it to one video, otherwise page with cursor.
+func videoChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	response := &videoChangesResponse{}
+	var err error
+
+	if id := r.FormValue("video_id"); id != "" {
+		videoId, perr := strconv.ParseInt(id, 10, 64)
+		if perr != nil {
+			http.Error(w, "Bad video_id", http.StatusBadRequest)
+			return
+		}
+		response.Revisions, err = db.VideoRevisions(context, videoId)
+	} else {
+		response.Revisions, response.Cursor, err = db.RecentVideoRevisions(context, r.FormValue("cursor"), pageSize)
+	}
+
+	if err != nil {
+		context.Errorf("video changes: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(context, w, response)
+}
+
+// get lists every category. post with id and hidden and/or display_name to override one, an empty display_name
+// goes back to giantbomb's name.
+func categoriesHandler(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	switch r.Method {
+	case "GET":
+		registry, err := categories.Load(context)
+		if err != nil {
+			context.Errorf("categories.Load: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(context, w, registry.All())
+	case "POST":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad id", http.StatusBadRequest)
+			return
+		}
+
+		var hidden *bool
+		if value := r.FormValue("hidden"); value != "" {
+			h, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "Bad hidden", http.StatusBadRequest)
+				return
+			}
+			hidden = &h
+		}
+		_, rename := r.Form["display_name"]
+
+		category, err := db.UpdateVideoCategory(context, id, func(category *db.VideoCategory) {
+			if hidden != nil {
+				category.Hidden = *hidden
+			}
+			if rename {
+				category.DisplayName = r.FormValue("display_name")
+			}
+		})
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "Unknown category", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			context.Errorf("UpdateVideoCategory: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		categories.Invalidate(context)
+
+		writeJSON(context, w, category)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+type flagsResponse struct {
+	Defaults map[string]bool  `json:"defaults"`
+	Stored   []db.FeatureFlag `json:"stored"`
+}
+
+// get lists the stored flags and the defaults for the rest. post with name and the FeatureFlag fields to create or
+// replace a flag (platforms comma separated), or name and action=delete to fall back to the default.
+func flagsHandler(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	switch r.Method {
+	case "GET":
+		stored, err := db.FeatureFlags(context)
+		if err != nil {
+			context.Errorf("FeatureFlags: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(context, w, &flagsResponse{flags.Defaults(), stored})
+	case "POST":
+		flag, err := parseFlag(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if r.FormValue("action") == "delete" {
+			err = db.DeleteFeatureFlag(context, flag.Name)
+		} else {
+			err = db.PutFeatureFlag(context, flag)
+		}
+		if err != nil {
+			context.Errorf("flag update: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		flags.Invalidate(context)
+
+		writeJSON(context, w, flag)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func parseFlag(r *http.Request) (*db.FeatureFlag, error) {
+	flag := &db.FeatureFlag{
+		Name:        r.FormValue("name"),
+		Description: r.FormValue("description"),
+		Platforms:   []string{},
+		MinVersion:  r.FormValue("min_version"),
+		MaxVersion:  r.FormValue("max_version"),
+	}
+	if flag.Name == "" {
+		return nil, errors.New("Missing name")
+	}
+
+	var err error
+	if flag.Enabled, err = strconv.ParseBool(r.FormValue("enabled")); err != nil && r.FormValue("enabled") != "" {
+		return nil, errors.New("Bad enabled")
+	}
+
+	flag.RolloutPercent = 100
+	if value := r.FormValue("rollout_percent"); value != "" {
+		if flag.RolloutPercent, err = strconv.Atoi(value); err != nil || flag.RolloutPercent < 0 || flag.RolloutPercent > 100 {
+			return nil, errors.New("Bad rollout_percent")
+		}
+	}
+
+	for _, version := range []string{flag.MinVersion, flag.MaxVersion} {
+		if _, err := client.ParseVersion(version); version != "" && err != nil {
+			return nil, err
+		}
+	}
+
+	// stored the way client.FromRequest reports them, or they'd never match
+	for _, platform := range strings.Split(r.FormValue("platforms"), ",") {
+		platform = strings.ToLower(strings.TrimSpace(platform))
+		if platform == "" {
+			continue
+		}
+		if !client.KnownPlatform(platform) {
+			return nil, errors.New("Unknown platform " + platform)
+		}
+		flag.Platforms = append(flag.Platforms, platform)
+	}
+
+	return flag, nil
+}
+
+type deviceResponse struct {
+	Device     *db.Device                 `json:"device"`
+	Preference *db.NotificationPreference `json:"preference"`
+}
+
+// a device and its preference by token. either may be null.
+func devicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	response := &deviceResponse{}
+	var err error
+	if response.Device, err = db.GetDevice(context, token); err != nil && err != datastore.ErrNoSuchEntity {
+		context.Errorf("GetDevice: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if response.Preference, err = db.GetNotificationPreference(context, token); err != nil && err != datastore.ErrNoSuchEntity {
+		context.Errorf("GetNotificationPreference: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(context, w, response)
+}
+
+// get reports what a stale device prune would do with the next batch of the dry run scan. post prunes a batch for
+// real.
+func pruneDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	report, err := tasks.PruneDevices(context, r.Method == "GET")
+	if err != nil {
+		context.Errorf("PruneDevices: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(context, w, report)
+}
+
+// a notification with its payload readable, and live totals while it's still sending
+type pushView struct {
+	*db.PushNotification
+	Payload   json.RawMessage `json:"payload"`
+	PagesDone int             `json:"pages_done"`
+	Seconds   float64         `json:"seconds,omitempty"` // from created to finished
+	PageStats []db.PushPage   `json:"page_stats,omitempty"`
+}
+
+func newPushView(context appengine.Context, notification *db.PushNotification, withPages bool) (*pushView, error) {
+	view := &pushView{PushNotification: notification, Payload: json.RawMessage(notification.Message)}
+
+	if !notification.Finished.IsZero() && !withPages {
+		view.PagesDone = notification.Pages
+		view.Seconds = notification.Finished.Sub(notification.Created).Seconds()
+		return view, nil
+	}
+
+	pages, err := db.PushPages(context, notification.Key)
+	if err != nil {
+		return nil, err
+	}
+	view.PagesDone = len(pages)
+	if notification.Finished.IsZero() {
+		for i := range pages {
+			notification.Add(&pages[i].PushStats)
+		}
+	} else {
+		view.Seconds = notification.Finished.Sub(notification.Created).Seconds()
+	}
+	if withPages {
+		view.PageStats = pages
+	}
+	return view, nil
+}
+
+type pushesResponse struct {
+	Notifications []*pushView `json:"notifications"`
+	Cursor        string      `json:"cursor,omitempty"`
+}
+
+// pushes newest first, optionally only those to category, paged with cursor. key gets one push with its pages.
+func pushesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	if key := r.FormValue("key"); key != "" {
+		notification, err := db.GetPushNotification(context, key)
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "Unknown push", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			context.Errorf("GetPushNotification: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		view, err := newPushView(context, notification, true)
+		if err != nil {
+			context.Errorf("push view: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(context, w, view)
+		return
+	}
+
+	notifications, cursor, err := db.RecentPushNotifications(context, r.FormValue("category"), r.FormValue("cursor"), pageSize)
+	if err != nil {
+		context.Errorf("RecentPushNotifications: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	response := &pushesResponse{Notifications: []*pushView{}, Cursor: cursor}
+	for i := range notifications {
+		view, err := newPushView(context, &notifications[i], false)
+		if err != nil {
+			context.Errorf("push view: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		response.Notifications = append(response.Notifications, view)
+	}
+
+	writeJSON(context, w, response)
+}
+
+func writeJSON(context appengine.Context, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(v); err != nil {
+		context.Errorf("Encode error: %v", err)
+	}
+}
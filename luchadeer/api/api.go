@@ -34,12 +34,16 @@ import (
 	"appengine"
 	"appengine/memcache"
 	"appengine/urlfetch"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"luchadeer/categories"
+	"luchadeer/client"
 	"luchadeer/config"
-	"luchadeer/db"
+	"luchadeer/flags"
 	"luchadeer/giantbomb"
 	"net/http"
 	"net/url"
@@ -49,49 +53,39 @@ import (
 )
 
 func Init() {
-	http.HandleFunc("/api/1/preferences", preferencesHandler)
+	handleFunc("/api/1/preferences", preferencesHandler)
+	handleFunc("/api/1/config", clientConfigHandler)
+
+	// our own copy of the video list
+	handle("/api/1/videos", requireFlag(flags.LocalVideos, http.HandlerFunc(videosHandler)))
+	handle("/api/1/search/videos", requireFlag(flags.LocalSearch, http.HandlerFunc(searchVideosHandler)))
+	handle("/api/1/search/suggest", requireFlag(flags.SearchSuggest, http.HandlerFunc(suggestHandler)))
 
 	// duplicating the giantbomb api to make the client work easier
-	http.Handle("/api/1/giantbomb/videos/", NewGiantBombCacheHandler(VideoListCacheConfig))
-	http.Handle("/api/1/giantbomb/video/", NewGiantBombCacheHandler(VideoCacheConfig))
-	http.Handle("/api/1/giantbomb/games/", NewGiantBombCacheHandler(GameListCacheConfig))
-	http.Handle("/api/1/giantbomb/game/", NewGiantBombCacheHandler(GameCacheConfig))
+	handle("/api/1/giantbomb/videos/", proxy(NewGiantBombCacheHandler(VideoListCacheConfig)))
+	handle("/api/1/giantbomb/video/", proxy(NewGiantBombCacheHandler(VideoCacheConfig)))
+	handle("/api/1/giantbomb/games/", proxy(NewGiantBombCacheHandler(GameListCacheConfig)))
+	handle("/api/1/giantbomb/game/", proxy(NewGiantBombCacheHandler(GameCacheConfig)))
 
-	http.Handle("/api/1/giantbomb/video_types/", NewGiantBombCacheHandler(VideoTypesCacheConfig))
+	handle("/api/1/giantbomb/video_types/", proxy(NewGiantBombCacheHandler(VideoTypesCacheConfig)))
 
-	http.Handle("/api/1/giantbomb/search/", NewGiantBombCacheHandler(SearchCacheConfig))
+	handle("/api/1/giantbomb/search/", proxy(requireFlag(flags.SearchProxy, recordSearches(NewGiantBombCacheHandler(SearchCacheConfig)))))
 
-	http.Handle("/api/1/youtube/unarchived_videos", NewYouTubeCacheHandler(YouTubeCacheConfig))
+	handle("/api/1/youtube/unarchived_videos", proxy(NewYouTubeCacheHandler(YouTubeCacheConfig)))
 }
 
-// update user preferences. post only.
-func preferencesHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "", http.StatusMethodNotAllowed)
-		return
-	}
-
-	context := appengine.NewContext(r)
-
-	var preferences db.NotificationPreference
-
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&preferences); err != nil {
-		http.Error(w, "Error decoding json", http.StatusInternalServerError)
-		context.Errorf("Decode error: %v", err)
-		return
-	}
-	defer r.Body.Close()
-
-	if err := db.UpdateNotificationPreference(context, &preferences); err != nil {
-		http.Error(w, "Error updating preferences", http.StatusInternalServerError)
-		context.Infof("UpdateNotificationPreferences: %v", err)
-	}
+// every proxied endpoint can be turned off with flags.ProxyRequests
+func proxy(h http.Handler) http.Handler {
+	return requireFlag(flags.ProxyRequests, h)
 }
 
 type CacheConfig struct {
-	QueryParams map[string]func([]string) bool
+	QueryParams map[string]func(appengine.Context, []string) bool
 	TTL         time.Duration
+	// typed response used for shape=slim. nil if the resource has no slim form.
+	Slim func() giantbomb.GiantBombResponse
+	// called with every body fetched from upstream that was small enough to cache. optional.
+	Observe func(appengine.Context, []byte)
 }
 
 var VideoTypesCacheConfig = &CacheConfig{
@@ -100,11 +94,14 @@ var VideoTypesCacheConfig = &CacheConfig{
 
 var VideoCacheConfig = &CacheConfig{
 	TTL: config.VideoDetailCacheTTL,
+	Slim: func() giantbomb.GiantBombResponse {
+		return &giantbomb.VideoGiantBombResponse{}
+	},
 }
 
 var VideoListCacheConfig = &CacheConfig{
-	QueryParams: map[string]func([]string) bool{
-		"offset": func(values []string) bool {
+	QueryParams: map[string]func(appengine.Context, []string) bool{
+		"offset": func(context appengine.Context, values []string) bool {
 			if len(values) > 1 {
 				return false
 			}
@@ -117,28 +114,42 @@ var VideoListCacheConfig = &CacheConfig{
 			}
 			return true
 		},
-		"video_type": func(values []string) bool {
+		"video_type": func(context appengine.Context, values []string) bool {
 			if len(values) > 1 {
 				return false
 			}
-			i, err := strconv.Atoi(values[0])
+			id, err := strconv.ParseInt(values[0], 10, 64)
 			if err != nil {
 				return false
 			}
-			_, ok := config.ValidVideoCategories[i]
+			registry, err := categories.Load(context)
+			if err != nil {
+				context.Errorf("categories.Load: %v", err)
+				return false
+			}
+			_, ok := registry.ById(id)
 			return ok
 		},
 	},
 	TTL: config.ListRequestCacheTTL,
+	Slim: func() giantbomb.GiantBombResponse {
+		return &giantbomb.VideosGiantBombResponse{}
+	},
 }
 
 var GameCacheConfig = &CacheConfig{
 	TTL: config.GameDetailCacheTTL,
+	Slim: func() giantbomb.GiantBombResponse {
+		return &giantbomb.GameGiantBombResponse{}
+	},
+	Observe: func(context appengine.Context, body []byte) {
+		observeGames(context, body, &giantbomb.GameGiantBombResponse{})
+	},
 }
 
 var GameListCacheConfig = &CacheConfig{
-	QueryParams: map[string]func([]string) bool{
-		"offset": func(value []string) bool {
+	QueryParams: map[string]func(appengine.Context, []string) bool{
+		"offset": func(context appengine.Context, value []string) bool {
 			if len(value) > 1 {
 				return false
 			}
@@ -151,7 +162,7 @@ var GameListCacheConfig = &CacheConfig{
 			}
 			return true
 		},
-		"sort": func(values []string) bool {
+		"sort": func(context appengine.Context, values []string) bool {
 			if len(values) > 1 {
 				return false
 			}
@@ -159,17 +170,23 @@ var GameListCacheConfig = &CacheConfig{
 		},
 	},
 	TTL: config.ListRequestCacheTTL,
+	Slim: func() giantbomb.GiantBombResponse {
+		return &giantbomb.GamesGiantBombResponse{}
+	},
+	Observe: func(context appengine.Context, body []byte) {
+		observeGames(context, body, &giantbomb.GamesGiantBombResponse{})
+	},
 }
 
 var SearchCacheConfig = &CacheConfig{
-	QueryParams: map[string]func([]string) bool{
-		"query": func(values []string) bool {
+	QueryParams: map[string]func(appengine.Context, []string) bool{
+		"query": func(context appengine.Context, values []string) bool {
 			if len(values) > 1 {
 				return false
 			}
 			return true
 		},
-		"resources": func(values []string) bool {
+		"resources": func(context appengine.Context, values []string) bool {
 			if len(values) > 1 {
 				return false
 			}
@@ -181,17 +198,20 @@ var SearchCacheConfig = &CacheConfig{
 		},
 	},
 	TTL: config.DefaultCacheTTL,
+	Observe: func(context appengine.Context, body []byte) {
+		observeGames(context, body, &giantbomb.SearchGiantBombResponse{})
+	},
 }
 
 var YouTubeCacheConfig = &CacheConfig{
-	QueryParams: map[string]func([]string) bool{
-		"q": func(values []string) bool {
+	QueryParams: map[string]func(appengine.Context, []string) bool{
+		"q": func(context appengine.Context, values []string) bool {
 			if len(values) > 1 {
 				return false
 			}
 			return true
 		},
-		"pageToken": func(values []string) bool {
+		"pageToken": func(context appengine.Context, values []string) bool {
 			if len(values) > 1 {
 				return false
 			}
@@ -202,15 +222,21 @@ var YouTubeCacheConfig = &CacheConfig{
 }
 
 type CacheHandler struct {
-	p ProxyHandler
+	p       ProxyHandler
+	slim    ProxyHandler // handles shape=slim, nil if unsupported
+	observe func(appengine.Context, []byte)
 }
 
 func NewGiantBombCacheHandler(c *CacheConfig) *CacheHandler {
-	return &CacheHandler{&GiantBombProxyHandler{c}}
+	h := &CacheHandler{p: &GiantBombProxyHandler{c}, observe: c.Observe}
+	if c.Slim != nil {
+		h.slim = &SlimGiantBombProxyHandler{GiantBombProxyHandler{c}}
+	}
+	return h
 }
 
 func NewYouTubeCacheHandler(c *CacheConfig) *CacheHandler {
-	return &CacheHandler{&YouTubeProxyHandler{c}}
+	return &CacheHandler{p: &YouTubeProxyHandler{c}}
 }
 
 func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -221,8 +247,24 @@ func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	context := appengine.NewContext(r)
 
-	h.p.PrepareURL(context, r.URL)
-	key := h.p.URLCacheKey(context, r.URL)
+	p := h.p
+	query := r.URL.Query()
+	if shape, ok := query["shape"]; ok {
+		if len(shape) > 1 || shape[0] != "slim" || h.slim == nil {
+			http.Error(w, "Unsupported shape", http.StatusBadRequest)
+			return
+		}
+		// the full response is a superset of the slim one, so fall back to it when slim is off
+		info, _ := client.FromRequest(r)
+		if info != nil && flags.Enabled(context, flags.SlimResponses, flags.TargetFor(info)) {
+			p = h.slim
+		}
+		query.Del("shape")
+		r.URL.RawQuery = query.Encode()
+	}
+
+	p.PrepareURL(context, r.URL)
+	key := p.URLCacheKey(context, r.URL)
 
 	// check cache
 	cached, err := memcache.Get(context, key)
@@ -251,16 +293,34 @@ func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer response.Body.Close()
 
-	body, ttl, err := h.p.ProcessResponse(context, response)
+	// stream the body to the client, keeping a copy for the cache as long as it stays small enough.
+	out := &countingWriter{w: w}
+	buffer := &cacheBuffer{max: config.ProxyCacheMaxBytes}
+
+	ttl, err := p.ProcessResponse(context, response, io.MultiWriter(out, buffer))
 	if err != nil {
 		context.Errorf("process response error: %v", err)
-		http.Error(w, "", http.StatusInternalServerError)
+		if out.n == 0 {
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+		// otherwise the client already has a partial body and there's nothing else we can tell it.
+		return
+	}
+
+	if buffer.overflow {
+		context.Infof("not caching %s, body is over %v bytes", key, buffer.max)
+		return
+	}
+
+	// a body cut off or followed by garbage upstream would be served to everyone for the whole ttl
+	if !json.Valid(buffer.Bytes()) {
+		context.Errorf("not caching %s, body isn't complete json", key)
 		return
 	}
 
 	item := &memcache.Item{
 		Key:        key,
-		Value:      body,
+		Value:      buffer.Bytes(),
 		Expiration: ttl,
 	}
 
@@ -268,13 +328,49 @@ func (h *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	context.Infof("cached: %s", key)
 
-	w.Write(body)
+	if h.observe != nil {
+		h.observe(context, buffer.Bytes())
+	}
 }
 
+// ProxyHandler streams an upstream response to w and returns the ttl it should be cached with. An error returned
+// before anything is written to w lets the caller send an error status instead.
 type ProxyHandler interface {
 	PrepareURL(appengine.Context, *url.URL) error
 	URLCacheKey(appengine.Context, *url.URL) string
-	ProcessResponse(appengine.Context, *http.Response) ([]byte, time.Duration, error) // body, ttl
+	ProcessResponse(appengine.Context, *http.Response, io.Writer) (time.Duration, error) // ttl
+}
+
+// countingWriter counts the bytes that make it to the client.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// cacheBuffer keeps a copy of a proxied body for memcache. Once the body grows past max the copy is dropped, but
+// writes keep succeeding so the client stream isn't interrupted.
+type cacheBuffer struct {
+	bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (b *cacheBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if b.Len()+len(p) > b.max {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
 }
 
 type GiantBombProxyHandler struct {
@@ -292,7 +388,7 @@ func (h *GiantBombProxyHandler) PrepareURL(context appengine.Context, u *url.URL
 	query.Del("limit")
 
 	for param, values := range query {
-		if check, ok := h.c.QueryParams[param]; !ok || !check(values) {
+		if check, ok := h.c.QueryParams[param]; !ok || !check(context, values) {
 			return errors.New("Unusable query param")
 		}
 	}
@@ -309,31 +405,172 @@ func (h *GiantBombProxyHandler) URLCacheKey(context appengine.Context, u *url.UR
 	return fmt.Sprintf("giantbomb/%s", u.RequestURI())
 }
 
-func (h *GiantBombProxyHandler) ProcessResponse(context appengine.Context, response *http.Response) ([]byte, time.Duration, error) {
-	// we have to parse the json to make sure we have an OK from the content provider.
-	var parsed giantbomb.BaseGiantBombResponse
-	var body []byte
+func (h *GiantBombProxyHandler) ProcessResponse(context appengine.Context, response *http.Response, w io.Writer) (time.Duration, error) {
+	// we have to check the status code to make sure we have an OK from the content provider. giantbomb puts it
+	// ahead of the results, so read just enough of the body to find it and hold that back until we know the
+	// json is sane.
+	var head bytes.Buffer
+	limited := &cacheBuffer{max: config.ProxyCacheMaxBytes}
+	decoder := json.NewDecoder(io.TeeReader(response.Body, io.MultiWriter(&head, limited)))
+
+	statusCode, message, err := scanStatus(decoder, limited)
+	if err != nil && !limited.overflow {
+		context.Errorf("Status scan error: %v, %s", err, head.Bytes())
+		// Should we return the busted request to user?
+		return -1, err
+	}
 
-	body, rErr := ioutil.ReadAll(response.Body)
-	if rErr != nil {
-		context.Errorf("Request read error: %v", rErr)
-		return nil, -1, rErr
+	ttl := h.c.TTL
+	if limited.overflow {
+		// never found the status before the results, so we can't vouch for this body.
+		context.Infof("No status code in the first %v bytes", limited.max)
+		ttl = config.BadRequestCacheTTL
+	} else if statusCode != giantbomb.StatusOK && statusCode != giantbomb.StatusRestrictedContent {
+		// we got an error from the content provider, log it and drop the ttl.
+		context.Infof("Bad status returned by content provider: %v: %v", statusCode, message)
+		ttl = config.BadRequestCacheTTL
 	}
 
-	if dErr := json.Unmarshal(body, &parsed); dErr != nil {
-		context.Errorf("Unmarshal error: %v, %v", dErr, body)
-		// Should we return the busted request to user?
-		return nil, -1, dErr
+	read := int64(head.Len())
+	if _, err := head.WriteTo(w); err != nil {
+		return -1, err
 	}
+	n, err := io.Copy(w, response.Body)
+	if err == nil {
+		err = checkLength(response, read+n)
+	}
+	if err != nil {
+		context.Errorf("Response stream error: %v", err)
+		return -1, err
+	}
+
+	return ttl, nil
+}
+
+// checkLength makes sure n, the bytes read from response, is all of a body that declared its length.
+func checkLength(response *http.Response, n int64) error {
+	if response.ContentLength >= 0 && n != response.ContentLength {
+		return fmt.Errorf("Read %v of %v bytes", n, response.ContentLength)
+	}
+	return nil
+}
+
+// scanStatus walks the top level of a giantbomb response until it finds status_code, skipping over everything
+// else without decoding it. It gives up once stop overflows.
+func scanStatus(decoder *json.Decoder, stop *cacheBuffer) (int, string, error) {
+	if err := expectDelim(decoder, '{'); err != nil {
+		return 0, "", err
+	}
+
+	var message string
+	for decoder.More() && !stop.overflow {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, "", err
+		}
+
+		switch token {
+		case "status_code":
+			var statusCode int
+			if err := decoder.Decode(&statusCode); err != nil {
+				return 0, "", err
+			}
+			return statusCode, message, nil
+		case "error":
+			if err := decoder.Decode(&message); err != nil {
+				return 0, "", err
+			}
+		default:
+			if err := skipValue(decoder, stop); err != nil {
+				return 0, "", err
+			}
+		}
+	}
+
+	// no status at all, treat it like an error from the content provider.
+	return 0, message, nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("Expected %v, got %v", delim, token)
+	}
+	return nil
+}
+
+// skipValue consumes the next value from decoder, however deeply nested, unless stop overflows first.
+func skipValue(decoder *json.Decoder, stop *cacheBuffer) error {
+	depth := 0
+	for !stop.overflow {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// SlimGiantBombProxyHandler decodes giantbomb responses into the typed structs in the giantbomb package and
+// re-encodes them, which drops every field the client doesn't render.
+type SlimGiantBombProxyHandler struct {
+	GiantBombProxyHandler
+}
 
+func (h *SlimGiantBombProxyHandler) URLCacheKey(context appengine.Context, u *url.URL) string {
+	return fmt.Sprintf("giantbomb/slim/%s", u.RequestURI())
+}
+
+func (h *SlimGiantBombProxyHandler) ProcessResponse(context appengine.Context, response *http.Response, w io.Writer) (time.Duration, error) {
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return -1, err
+	}
+
+	// error statuses come with "results":[] whatever the endpoint, which won't decode into a single result, so the
+	// results are only decoded once the status says they're there
+	var raw struct {
+		giantbomb.BaseGiantBombResponse
+		Results json.RawMessage `json:"results"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		context.Errorf("Slim decode error: %v", err)
+		return -1, err
+	}
+
+	var parsed interface{}
 	ttl := h.c.TTL
-	if parsed.StatusCode != giantbomb.StatusOK && parsed.StatusCode != giantbomb.StatusRestrictedContent {
-		// we got an error from the content provider, log it and drop the ttl.
-		context.Infof("Bad status returned by content provider: %v: %v", parsed.StatusCode, parsed.Message)
+	if statusCode, message := raw.Status(); statusCode == giantbomb.StatusOK || statusCode == giantbomb.StatusRestrictedContent {
+		slim := h.c.Slim()
+		if err := json.Unmarshal(body, slim); err != nil {
+			context.Errorf("Slim decode error: %v", err)
+			return -1, err
+		}
+		parsed = slim
+	} else {
+		context.Infof("Bad status returned by content provider: %v: %v", statusCode, message)
 		ttl = config.BadRequestCacheTTL
+		parsed = &giantbomb.InterfaceGiantBombResponse{BaseGiantBombResponse: raw.BaseGiantBombResponse, Results: []interface{}{}}
 	}
 
-	return body, ttl, nil
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(parsed); err != nil {
+		return -1, err
+	}
+
+	return ttl, nil
 }
 
 type YouTubeProxyHandler struct {
@@ -354,7 +591,7 @@ func (h *YouTubeProxyHandler) PrepareURL(context appengine.Context, u *url.URL)
 	query.Del("order")
 
 	for param, values := range query {
-		if check, ok := h.c.QueryParams[param]; !ok || !check(values) {
+		if check, ok := h.c.QueryParams[param]; !ok || !check(context, values) {
 			return errors.New("Unusable query param")
 		}
 	}
@@ -382,11 +619,14 @@ func (h *YouTubeProxyHandler) URLCacheKey(context appengine.Context, u *url.URL)
 	return fmt.Sprintf("youtube/%s", u.RequestURI())
 }
 
-func (h *YouTubeProxyHandler) ProcessResponse(context appengine.Context, response *http.Response) ([]byte, time.Duration, error) {
-	body, err := ioutil.ReadAll(response.Body)
+func (h *YouTubeProxyHandler) ProcessResponse(context appengine.Context, response *http.Response, w io.Writer) (time.Duration, error) {
+	n, err := io.Copy(w, response.Body)
+	if err == nil {
+		err = checkLength(response, n)
+	}
 	if err != nil {
-		return nil, -1, err
+		return -1, err
 	}
 
-	return body, h.c.TTL, nil
-}
\ No newline at end of file
+	return h.c.TTL, nil
+}
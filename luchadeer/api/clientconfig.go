@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"luchadeer/categories"
+	"luchadeer/client"
+	"luchadeer/config"
+	"luchadeer/flags"
+	"net/http"
+)
+
+type clientCategory struct {
+	Id          int64  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// everything the client would otherwise hard-code. Version changes whenever anything else does. Features holds every
+// feature flag as it applies to the requesting device.
+type clientConfig struct {
+	Version            string           `json:"version"`
+	Categories         []clientCategory `json:"categories"`
+	MinVersion         string           `json:"min_version"`
+	LatestVersion      string           `json:"latest_version"`
+	DownloadURL        string           `json:"download_url"`
+	ProxyEnabled       bool             `json:"proxy_enabled"`
+	SearchProxyEnabled bool             `json:"search_proxy_enabled"`
+	Features           map[string]bool  `json:"features"`
+}
+
+func latestVersion(platform string) client.Version {
+	if v, ok := config.LatestVersions[platform]; ok {
+		return v
+	}
+	return minVersion(platform)
+}
+
+// everything but the flags, which depend on the device.
+func buildClientConfig(context appengine.Context, platform string) (*clientConfig, error) {
+	registry, err := categories.Load(context)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &clientConfig{
+		Categories:    []clientCategory{},
+		MinVersion:    minVersion(platform).String(),
+		LatestVersion: latestVersion(platform).String(),
+		DownloadURL:   config.ClientDownloadURL,
+	}
+	for _, category := range registry.Visible() {
+		c.Categories = append(c.Categories, clientCategory{category.Id, category.Name, categories.DisplayName(&category)})
+	}
+	return c, nil
+}
+
+// bootstrap configuration for clients. get only, supports If-None-Match with the version.
+func clientConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	info, err := client.FromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := "config/" + info.Platform
+
+	var c *clientConfig
+	if _, err := memcache.Gob.Get(context, key, &c); err != nil {
+		if err != memcache.ErrCacheMiss {
+			context.Errorf("memcache error: %v", err)
+		}
+
+		if c, err = buildClientConfig(context, info.Platform); err != nil {
+			context.Errorf("buildClientConfig: %v", err)
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		memcache.Gob.Set(context, &memcache.Item{
+			Key:        key,
+			Object:     c,
+			Expiration: config.ClientConfigCacheTTL,
+		})
+	}
+
+	set, err := flags.Load(context)
+	if err != nil {
+		context.Errorf("flags.Load: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	target := flags.TargetFor(info)
+	c.ProxyEnabled = set.Enabled(flags.ProxyRequests, target)
+	c.SearchProxyEnabled = c.ProxyEnabled && set.Enabled(flags.SearchProxy, target)
+	c.Features = set.All(target)
+
+	// version is a hash of everything else
+	unversioned, err := json.Marshal(c)
+	if err != nil {
+		context.Errorf("Marshal error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	sum := sha1.Sum(unversioned)
+	c.Version = hex.EncodeToString(sum[:8])
+
+	etag := `"` + c.Version + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(c); err != nil {
+		context.Errorf("Encode error: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"crypto/sha1"
+	"fmt"
+	"luchadeer/client"
+	"luchadeer/config"
+	"luchadeer/db"
+	"net/http"
+	"strings"
+)
+
+// record the device behind every request that names one. a device is written at most once per
+// config.DeviceSeenInterval unless what it reports about itself changes.
+func seeDevice(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, err := client.FromRequest(r); err == nil && info.Device != "" {
+			recordDevice(appengine.NewContext(r), info, info.Device)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func deviceFromInfo(info *client.Info, token string) *db.Device {
+	device := &db.Device{
+		Token:     token,
+		Platform:  info.Platform,
+		OSVersion: info.OSVersion,
+		Locale:    info.Locale,
+		Timezone:  info.Timezone,
+	}
+	if info.Version != nil {
+		device.AppVersion = info.Version.String()
+	}
+	return device
+}
+
+// tokens can be longer than a memcache key, so the key is a hash
+func deviceSeenKey(token string) string {
+	return fmt.Sprintf("device-seen-%x", sha1.Sum([]byte(token)))
+}
+
+func recordDevice(context appengine.Context, info *client.Info, token string) {
+	if !client.KnownPlatform(info.Platform) || !client.ValidToken(info.Platform, token) {
+		return
+	}
+
+	device := deviceFromInfo(info, token)
+	fingerprint := strings.Join([]string{device.Platform, device.AppVersion, device.OSVersion, device.Locale, device.Timezone}, "|")
+
+	key := deviceSeenKey(token)
+	if item, err := memcache.Get(context, key); err == nil && string(item.Value) == fingerprint {
+		return
+	} else if err != nil && err != memcache.ErrCacheMiss {
+		context.Errorf("memcache error: %v", err)
+	}
+
+	if _, err := db.TouchDevice(context, device); err != nil {
+		context.Errorf("TouchDevice: %v", err)
+		return
+	}
+
+	item := &memcache.Item{Key: key, Value: []byte(fingerprint), Expiration: config.DeviceSeenInterval}
+	if err := memcache.Set(context, item); err != nil {
+		context.Errorf("memcache error: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"appengine"
+	"appengine/datastore"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"luchadeer/categories"
+	"luchadeer/client"
+	"luchadeer/config"
+	"luchadeer/db"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// a device's notification preferences. get and delete take gcm_registration_id as a parameter, or the device
+// header. post replaces the preference, patch adds and removes categories. post and patch answer with what was
+// saved.
+func preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		getPreferences(w, r)
+	case "POST":
+		postPreferences(w, r)
+	case "PATCH":
+		patchPreferences(w, r)
+	case "DELETE":
+		deletePreferences(w, r)
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+func registrationId(r *http.Request) string {
+	if id := r.FormValue("gcm_registration_id"); id != "" {
+		return id
+	}
+	return r.Header.Get(client.DeviceHeader)
+}
+
+// decode a json body of at most PreferencesMaxBytes into v, or write a 400 saying why not
+func readPreferencesBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, config.PreferencesMaxBytes+1))
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return false
+	}
+	if len(body) > config.PreferencesMaxBytes {
+		http.Error(w, fmt.Sprintf("Body is over %v bytes", config.PreferencesMaxBytes), http.StatusBadRequest)
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		http.Error(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// everything wrong with a request, reported together as one 400
+type rejections []string
+
+func (r *rejections) add(format string, args ...interface{}) {
+	*r = append(*r, fmt.Sprintf(format, args...))
+}
+
+func (r rejections) write(w http.ResponseWriter) bool {
+	if len(r) == 0 {
+		return false
+	}
+	http.Error(w, strings.Join(r, "; "), http.StatusBadRequest)
+	return true
+}
+
+// a token short enough to be a key. the format can only be checked when the platform is known.
+func checkTokenLength(rejected *rejections, token string) {
+	if token == "" {
+		rejected.add("Missing gcm_registration_id")
+	} else if len(token) > client.MaxTokenLength {
+		rejected.add("gcm_registration_id is over %v bytes", client.MaxTokenLength)
+	}
+}
+
+// reject lists over PreferencesMaxCategories, and if checkKnown, categories that can't be subscribed to.
+// duplicates are dropped.
+func checkCategories(registry *categories.Registry, rejected *rejections, field string, list []string, checkKnown bool) []string {
+	if len(list) > config.PreferencesMaxCategories {
+		rejected.add("%v has %v categories, at most %v are allowed", field, len(list), config.PreferencesMaxCategories)
+		return list
+	}
+
+	unique := []string{}
+	seen := map[string]bool{}
+	unknown := []string{}
+	for _, category := range list {
+		if seen[category] {
+			continue
+		}
+		seen[category] = true
+		unique = append(unique, category)
+		if checkKnown && !registry.Subscribable(category) {
+			unknown = append(unknown, strconv.Quote(category))
+		}
+	}
+	if len(unknown) > 0 {
+		rejected.add("Unknown categories in %v: %v", field, strings.Join(unknown, ", "))
+	}
+	return unique
+}
+
+func loadRegistry(context appengine.Context, w http.ResponseWriter) *categories.Registry {
+	registry, err := categories.Load(context)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		context.Errorf("categories.Load: %v", err)
+		return nil
+	}
+	return registry
+}
+
+func getPreferences(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	id := registrationId(r)
+	var rejected rejections
+	checkTokenLength(&rejected, id)
+	if rejected.write(w) {
+		return
+	}
+
+	preference, err := db.GetNotificationPreference(context, id)
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "No preferences for device", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		context.Errorf("GetNotificationPreference: %v", err)
+		return
+	}
+
+	writePreference(context, w, preference)
+}
+
+func postPreferences(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	var preferences db.NotificationPreference
+	if !readPreferencesBody(w, r, &preferences) {
+		return
+	}
+
+	if preferences.Platform == "" {
+		info, err := client.FromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		preferences.Platform = info.Platform
+	}
+
+	registry := loadRegistry(context, w)
+	if registry == nil {
+		return
+	}
+
+	var rejected rejections
+	checkTokenLength(&rejected, preferences.GCMRegistrationId)
+	if !client.KnownPlatform(preferences.Platform) {
+		rejected.add("Unknown platform: %v", preferences.Platform)
+	} else if len(rejected) == 0 && !client.ValidToken(preferences.Platform, preferences.GCMRegistrationId) {
+		rejected.add("gcm_registration_id is not a %v push token", preferences.Platform)
+	}
+	preferences.Categories = checkCategories(registry, &rejected, "categories", preferences.Categories, true)
+	if rejected.write(w) {
+		return
+	}
+
+	if err := db.UpdateNotificationPreference(context, &preferences); err != nil {
+		http.Error(w, "Error updating preferences", http.StatusInternalServerError)
+		context.Infof("UpdateNotificationPreferences: %v", err)
+		return
+	}
+
+	// the token in the body may not be the one in the headers, e.g. on a fresh registration
+	if info, err := client.FromRequest(r); err == nil {
+		info.Platform = preferences.Platform
+		recordDevice(context, info, preferences.GCMRegistrationId)
+	}
+
+	writePreference(context, w, &preferences)
+}
+
+var errTooManyCategories = errors.New("Too many categories")
+
+type preferencesPatch struct {
+	GCMRegistrationId string   `json:"gcm_registration_id"`
+	Add               []string `json:"add"`
+	Remove            []string `json:"remove"`
+}
+
+// add and remove categories without the client sending the whole set. removes win over adds.
+func patchPreferences(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	var patch preferencesPatch
+	if !readPreferencesBody(w, r, &patch) {
+		return
+	}
+
+	if patch.GCMRegistrationId == "" {
+		patch.GCMRegistrationId = r.Header.Get(client.DeviceHeader)
+	}
+
+	registry := loadRegistry(context, w)
+	if registry == nil {
+		return
+	}
+
+	var rejected rejections
+	checkTokenLength(&rejected, patch.GCMRegistrationId)
+	patch.Add = checkCategories(registry, &rejected, "add", patch.Add, true)
+	// categories being removed may have gone from the registry since they were subscribed to, so they aren't checked
+	patch.Remove = checkCategories(registry, &rejected, "remove", patch.Remove, false)
+	if rejected.write(w) {
+		return
+	}
+
+	preference, err := db.PatchNotificationPreference(context, patch.GCMRegistrationId, func(preference *db.NotificationPreference) error {
+		patched := patchCategories(preference.Categories, patch.Add, patch.Remove)
+		if len(patched) > config.PreferencesMaxCategories && len(patched) > len(preference.Categories) {
+			return errTooManyCategories
+		}
+		preference.Categories = patched
+		return nil
+	})
+	if err == errTooManyCategories {
+		http.Error(w, fmt.Sprintf("At most %v categories are allowed", config.PreferencesMaxCategories), http.StatusBadRequest)
+		return
+	}
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "No preferences for device", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error updating preferences", http.StatusInternalServerError)
+		context.Errorf("PatchNotificationPreference: %v", err)
+		return
+	}
+
+	writePreference(context, w, preference)
+}
+
+func patchCategories(current, add, remove []string) []string {
+	removed := map[string]bool{}
+	for _, category := range remove {
+		removed[category] = true
+	}
+
+	patched := []string{}
+	seen := map[string]bool{}
+	for _, list := range [][]string{current, add} {
+		for _, category := range list {
+			if !removed[category] && !seen[category] {
+				seen[category] = true
+				patched = append(patched, category)
+			}
+		}
+	}
+	return patched
+}
+
+// forget a device, e.g. on logout or uninstall. deleting one that isn't stored is fine.
+func deletePreferences(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	id := registrationId(r)
+	var rejected rejections
+	checkTokenLength(&rejected, id)
+	if rejected.write(w) {
+		return
+	}
+
+	if err := db.DeleteDevices(context, []string{id}); err != nil {
+		http.Error(w, "Error deleting preferences", http.StatusInternalServerError)
+		context.Errorf("DeleteDevices: %v", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writePreference(context appengine.Context, w http.ResponseWriter, preference *db.NotificationPreference) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(preference); err != nil {
+		context.Errorf("Encode error: %v", err)
+	}
+}
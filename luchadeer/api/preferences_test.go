@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPatchCategories(t *testing.T) {
+	tests := []struct {
+		current, add, remove []string
+		want                 []string
+	}{
+		{nil, nil, nil, []string{}},
+		{[]string{"a", "b"}, nil, nil, []string{"a", "b"}},
+		{[]string{"a", "b"}, []string{"c"}, nil, []string{"a", "b", "c"}},
+		{[]string{"a", "b"}, []string{"b", "c", "c"}, nil, []string{"a", "b", "c"}},
+		{[]string{"a", "b", "c"}, nil, []string{"b"}, []string{"a", "c"}},
+		{[]string{"a"}, nil, []string{"z"}, []string{"a"}},
+		{[]string{"a", "a"}, nil, nil, []string{"a"}},
+		// removing wins over adding the same category
+		{[]string{"a"}, []string{"b"}, []string{"b"}, []string{"a"}},
+		{[]string{"a"}, nil, []string{"a"}, []string{}},
+	}
+
+	for _, test := range tests {
+		if got := patchCategories(test.current, test.add, test.remove); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("patchCategories(%q, %q, %q) = %q, want %q", test.current, test.add, test.remove, got, test.want)
+		}
+	}
+}
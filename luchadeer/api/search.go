@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"appengine"
+	"encoding/json"
+	"luchadeer/config"
+	"luchadeer/db"
+	"luchadeer/giantbomb"
+	"luchadeer/search"
+	"luchadeer/tasks"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// search our own copy of the videos. works when giantbomb doesn't and costs no api quota. get only.
+func searchVideosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	terms := search.QueryTerms(r.FormValue("query"))
+	if len(terms) == 0 {
+		http.Error(w, "Bad value for query", http.StatusBadRequest)
+		return
+	}
+
+	offset, limit := 0, config.SearchMaxLimit
+	if value := r.FormValue("offset"); value != "" {
+		var err error
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			http.Error(w, "Bad value for offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > config.SearchMaxLimit {
+			http.Error(w, "Bad value for limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	recordSearch(context, r.FormValue("query"))
+
+	videos, total, err := db.SearchVideos(context, terms, offset, limit)
+	if err != nil {
+		context.Errorf("SearchVideos: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	response := &giantbomb.VideosGiantBombResponse{Results: videos}
+	response.StatusCode = giantbomb.StatusOK
+	response.Error = "OK"
+	response.Limit = int64(limit)
+	response.Offset = int64(offset)
+	response.NumberOfPageResults = int64(len(videos))
+	response.NumberOfTotalResults = int64(total)
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		context.Errorf("Encode error: %v", err)
+	}
+}
+
+// the suggester this instance serves from, reloaded from the latest snapshot every config.SuggestReloadInterval
+var suggester struct {
+	sync.Mutex
+	s      *search.Suggester
+	loaded time.Time
+}
+
+func currentSuggester(context appengine.Context) *search.Suggester {
+	suggester.Lock()
+	defer suggester.Unlock()
+
+	if suggester.s != nil && time.Since(suggester.loaded) < config.SuggestReloadInterval {
+		return suggester.s
+	}
+
+	suggestions, err := db.GetSuggestionSnapshot(context)
+	if err != nil {
+		// keep serving the old one, if there is one, and try again next time
+		context.Errorf("GetSuggestionSnapshot: %v", err)
+		if suggester.s == nil {
+			suggester.s = search.NewSuggester(nil)
+		}
+		return suggester.s
+	}
+
+	suggester.s = search.NewSuggester(suggestions)
+	suggester.loaded = time.Now()
+	return suggester.s
+}
+
+type suggestResponse struct {
+	Query       string   `json:"query"`
+	Suggestions []string `json:"suggestions"`
+}
+
+// complete a partial search. get only.
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	limit := config.SuggestMaxLimit
+	if value := r.FormValue("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > config.SuggestMaxLimit {
+			http.Error(w, "Bad value for limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := r.FormValue("q")
+	response := &suggestResponse{
+		Query:       query,
+		Suggestions: currentSuggester(context).Complete(query, limit),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		context.Errorf("Encode error: %v", err)
+	}
+}
+
+// count searches that look like something a person would type towards the popular searches.
+func recordSearch(context appengine.Context, query string) {
+	normalized := search.Normalize(query)
+	if len(normalized) < 3 || len(normalized) > 64 {
+		return
+	}
+	tasks.CountSearch(context, query)
+}
+
+// record searches that go through h.
+func recordSearches(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			recordSearch(appengine.NewContext(r), r.FormValue("query"))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// pull game names out of proxied responses for suggestions.
+func observeGames(context appengine.Context, body []byte, parsed giantbomb.GiantBombResponse) {
+	if err := json.Unmarshal(body, parsed); err != nil {
+		context.Infof("observeGames: %v", err)
+		return
+	}
+	if statusCode, _ := parsed.Status(); statusCode != giantbomb.StatusOK {
+		return
+	}
+
+	names := []string{}
+	switch response := parsed.(type) {
+	case *giantbomb.GameGiantBombResponse:
+		names = append(names, response.Results.Name)
+	case *giantbomb.GamesGiantBombResponse:
+		for _, game := range response.Results {
+			names = append(names, game.Name)
+		}
+	case *giantbomb.SearchGiantBombResponse:
+		for _, result := range response.Results {
+			if result.ResourceType == "game" {
+				names = append(names, result.Name)
+			}
+		}
+	}
+
+	if len(names) == 0 {
+		return
+	}
+	if err := db.RecordGameNames(context, names); err != nil {
+		context.Errorf("RecordGameNames: %v", err)
+	}
+}
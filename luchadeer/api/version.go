@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"appengine"
+	"encoding/json"
+	"luchadeer/client"
+	"luchadeer/config"
+	"luchadeer/flags"
+	"net/http"
+	"strings"
+)
+
+// sent with http.StatusUpgradeRequired to clients older than the minimum version
+type upgradeResponse struct {
+	Error       string `json:"error"`
+	Platform    string `json:"platform"`
+	Version     string `json:"version"`
+	MinVersion  string `json:"min_version"`
+	DownloadURL string `json:"download_url"`
+}
+
+func minVersion(platform string) client.Version {
+	if v, ok := config.MinVersions[platform]; ok {
+		return v
+	}
+	return config.MinVersion
+}
+
+func versionExempt(path string) bool {
+	for _, exempt := range config.VersionExemptPaths {
+		if strings.HasPrefix(path, exempt) {
+			return true
+		}
+	}
+	return false
+}
+
+// turn away clients older than the minimum version for their platform, apart from the exempt paths.
+func requireVersion(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if versionExempt(r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		info, err := client.FromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		min := minVersion(info.Platform)
+		if (info.Version == nil && !config.RequireVersionHeader) || (info.Version != nil && !info.Version.Less(min)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		context := appengine.NewContext(r)
+		context.Infof("Outdated client: %v %v, min %v", info.Platform, info.Version, min)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUpgradeRequired)
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(&upgradeResponse{
+			Error:       "upgrade_required",
+			Platform:    info.Platform,
+			Version:     info.Version.String(),
+			MinVersion:  min.String(),
+			DownloadURL: config.ClientDownloadURL,
+		}); err != nil {
+			context.Errorf("Encode error: %v", err)
+		}
+	})
+}
+
+// answer http.StatusServiceUnavailable when flag is off for the requesting client.
+func requireFlag(flag string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, err := client.FromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !flags.Enabled(appengine.NewContext(r), flag, flags.TargetFor(info)) {
+			http.Error(w, "Disabled", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// register an api handler behind the version check
+func handle(pattern string, h http.Handler) {
+	http.Handle(pattern, requireVersion(seeDevice(h)))
+}
+
+func handleFunc(pattern string, h func(http.ResponseWriter, *http.Request)) {
+	handle(pattern, http.HandlerFunc(h))
+}
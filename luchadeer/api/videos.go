@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package api
+
+import (
+	"appengine"
+	"encoding/json"
+	"luchadeer/categories"
+	"luchadeer/config"
+	"luchadeer/db"
+	"luchadeer/giantbomb"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// /api/1/videos response. shaped like a giantbomb list response so the client can reuse its parsing.
+type videosResponse struct {
+	giantbomb.VideosGiantBombResponse
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// list videos from our own store. get only.
+func videosHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+
+	context := appengine.NewContext(r)
+
+	query, err := parseVideoQuery(context, r.URL.Query())
+	if _, ok := err.(badParamError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		context.Errorf("parseVideoQuery: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	videos, cursor, err := db.QueryVideos(context, query)
+	if err != nil {
+		if query.Cursor != "" {
+			// almost certainly a bad cursor, and not worth a 500
+			context.Infof("QueryVideos: %v", err)
+			http.Error(w, "Bad cursor", http.StatusBadRequest)
+			return
+		}
+		context.Errorf("QueryVideos: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	response := &videosResponse{Cursor: cursor}
+	response.StatusCode = giantbomb.StatusOK
+	response.Error = "OK"
+	response.Limit = int64(query.Limit)
+	response.NumberOfPageResults = int64(len(videos))
+	response.Results = videos
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		context.Errorf("Encode error: %v", err)
+	}
+}
+
+type badParamError string
+
+func (e badParamError) Error() string {
+	return "Bad value for " + string(e)
+}
+
+func parseVideoQuery(context appengine.Context, values url.Values) (*db.VideoQuery, error) {
+	query := &db.VideoQuery{Limit: config.VideoQueryMaxLimit}
+
+	for param, v := range values {
+		if len(v) > 1 {
+			return nil, badParamError(param)
+		}
+		value := v[0]
+
+		var err error
+		switch param {
+		case "video_type":
+			// take the giantbomb id, same as the proxy, but we store the name
+			var id int64
+			if id, err = strconv.ParseInt(value, 10, 64); err == nil {
+				registry, err := categories.Load(context)
+				if err != nil {
+					return nil, err
+				}
+				category, ok := registry.ById(id)
+				if !ok {
+					return nil, badParamError(param)
+				}
+				query.VideoType = category.Name
+			}
+		case "published_after":
+			query.PublishedAfter, err = parseDate(value)
+		case "published_before":
+			query.PublishedBefore, err = parseDate(value)
+		case "min_length":
+			query.MinLength, err = strconv.ParseInt(value, 10, 64)
+		case "max_length":
+			query.MaxLength, err = strconv.ParseInt(value, 10, 64)
+		case "cursor":
+			query.Cursor = value
+		case "limit":
+			query.Limit, err = strconv.Atoi(value)
+			if err == nil && (query.Limit < 1 || query.Limit > config.VideoQueryMaxLimit) {
+				return nil, badParamError(param)
+			}
+		default:
+			return nil, badParamError(param)
+		}
+		if err != nil {
+			return nil, badParamError(param)
+		}
+	}
+
+	return query, nil
+}
+
+// accepts a bare date or giantbomb's full timestamp, both in giantbomb's time zone
+func parseDate(value string) (time.Time, error) {
+	if t, err := giantbomb.ParseDate(value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, giantbomb.Location)
+}
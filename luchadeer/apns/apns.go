@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ProductionHost = "https://api.push.apple.com"
+var DevelopmentHost = "https://api.sandbox.push.apple.com"
+var MethodPost = "POST"
+
+// apple rejects tokens older than an hour and refreshing more than every 20 minutes
+const tokenLifetime = time.Minute * 50
+
+type Response struct {
+	StatusCode int
+	ApnsId     string
+	Reason     string        `json:"reason"`
+	Timestamp  int64         `json:"timestamp"` // when the token went invalid, for 410s
+	RetryAfter time.Duration `json:"-"`         // how long apns asked us to back off, for 429s and 503s
+}
+
+type APNs struct {
+	host   string
+	keyId  string
+	teamId string
+	topic  string
+	key    *ecdsa.PrivateKey
+	client *http.Client
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+// keyPEM is the .p8 key apple hands out. client has to speak http/2.
+func NewAPNs(host, keyId, teamId, topic string, keyPEM []byte, client *http.Client) (*APNs, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("No PEM block in APNs key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key is not an ECDSA key")
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &APNs{
+		host:   host,
+		keyId:  keyId,
+		teamId: teamId,
+		topic:  topic,
+		key:    key,
+		client: client,
+	}, nil
+}
+
+// the provider token, reissued as it nears expiry.
+func (a *APNs) bearer() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token != "" && time.Since(a.issued) < tokenLifetime {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": a.keyId})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": a.teamId, "iat": now.Unix()})
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signing))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// jws wants r and s as fixed width big endian, not asn.1
+	size := (a.key.Curve.Params().BitSize + 7) / 8
+	signature := append(pad(r, size), pad(s, size)...)
+
+	a.token = signing + "." + base64.RawURLEncoding.EncodeToString(signature)
+	a.issued = now
+	return a.token, nil
+}
+
+func pad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// apns request headers beyond the ones Send always sets. zero values are left out.
+type Options struct {
+	PushType   string    // alert or background
+	Priority   int       // 10 immediate, 5 power considerate
+	Expiration time.Time // apns stops trying to deliver after this
+	CollapseId string    // notifications with the same id replace each other on the device
+}
+
+// send one notification. payload has to include the aps dictionary.
+func (a *APNs) Send(deviceToken string, payload map[string]interface{}, options *Options) (*Response, error) {
+	marshalled, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(MethodPost, a.host+"/3/device/"+deviceToken, bytes.NewBuffer(marshalled))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := a.bearer()
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Authorization", "bearer "+token)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("apns-topic", a.topic)
+	if options != nil {
+		if options.PushType != "" {
+			req.Header.Add("apns-push-type", options.PushType)
+		}
+		if options.Priority != 0 {
+			req.Header.Add("apns-priority", strconv.Itoa(options.Priority))
+		}
+		if !options.Expiration.IsZero() {
+			req.Header.Add("apns-expiration", strconv.FormatInt(options.Expiration.Unix(), 10))
+		}
+		if options.CollapseId != "" {
+			req.Header.Add("apns-collapse-id", options.CollapseId)
+		}
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	response := &Response{
+		StatusCode: resp.StatusCode,
+		ApnsId:     resp.Header.Get("apns-id"),
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		response.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// errors come with a json body explaining them
+		decoder := json.NewDecoder(resp.Body)
+		if err := decoder.Decode(response); err != nil {
+			return nil, fmt.Errorf("Non OK return status without a reason: %v", resp.StatusCode)
+		}
+	}
+
+	return response, nil
+}
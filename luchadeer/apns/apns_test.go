@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/net/http2"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// a fake apns that only answers http/2. the device token picks the answer.
+func fakeAPNs(t *testing.T, key *ecdsa.PrivateKey) (*httptest.Server, *http.Client) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("request over %v, apns wants http/2", r.Proto)
+		}
+		if r.Header.Get("apns-topic") != "com.example.app" {
+			t.Errorf("apns-topic = %q", r.Header.Get("apns-topic"))
+		}
+		if !validBearer(key, r.Header.Get("Authorization")) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"reason":"InvalidProviderToken"}`)
+			return
+		}
+
+		w.Header().Set("apns-id", "apns-id-1")
+		switch strings.TrimPrefix(r.URL.Path, "/3/device/") {
+		case "ok":
+			w.WriteHeader(http.StatusOK)
+		case "gone":
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprint(w, `{"reason":"Unregistered","timestamp":1500000000000}`)
+		case "bad":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+		case "busy":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"reason":"TooManyRequests"}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	transport := &http2.Transport{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+	return server, &http.Client{Transport: transport}
+}
+
+func validBearer(key *ecdsa.PrivateKey, header string) bool {
+	parts := strings.Split(strings.TrimPrefix(header, "bearer "), ".")
+	if len(parts) != 3 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return false
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(&key.PublicKey, digest[:], r, s)
+}
+
+func TestSend(t *testing.T) {
+	key, keyPEM := testKey(t)
+	server, client := fakeAPNs(t, key)
+	defer server.Close()
+
+	a, err := NewAPNs(server.URL, "KEYID", "TEAMID", "com.example.app", keyPEM, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token      string
+		status     int
+		reason     string
+		retryAfter time.Duration
+	}{
+		{"ok", http.StatusOK, "", 0},
+		{"gone", http.StatusGone, "Unregistered", 0},
+		{"bad", http.StatusBadRequest, "BadDeviceToken", 0},
+		{"busy", http.StatusTooManyRequests, "TooManyRequests", time.Second * 30},
+	}
+
+	for _, test := range tests {
+		response, err := a.Send(test.token, map[string]interface{}{"aps": map[string]interface{}{}}, &Options{PushType: "background", Priority: 5})
+		if err != nil {
+			t.Errorf("Send(%v): %v", test.token, err)
+			continue
+		}
+		if response.StatusCode != test.status || response.Reason != test.reason || response.RetryAfter != test.retryAfter {
+			t.Errorf("Send(%v) = %v %q retry after %v, want %v %q retry after %v", test.token,
+				response.StatusCode, response.Reason, response.RetryAfter, test.status, test.reason, test.retryAfter)
+		}
+		if response.ApnsId != "apns-id-1" {
+			t.Errorf("Send(%v) apns id = %q", test.token, response.ApnsId)
+		}
+	}
+}
+
+func TestBearerIsReused(t *testing.T) {
+	_, keyPEM := testKey(t)
+	a, err := NewAPNs("", "KEYID", "TEAMID", "com.example.app", keyPEM, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := a.bearer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := a.bearer()
+	if first != second {
+		t.Errorf("bearer was reissued before it expired")
+	}
+
+	a.issued = time.Now().Add(-tokenLifetime)
+	if third, _ := a.bearer(); third == first {
+		t.Errorf("bearer wasn't reissued once expired")
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package categories
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"luchadeer/config"
+	"luchadeer/db"
+	"sort"
+)
+
+// categories that aren't giantbomb video types but can still be subscribed to
+const Live = "live"
+
+const cacheKey = "categories/registry"
+
+// Registry answers questions about the known video categories.
+type Registry struct {
+	categories []db.VideoCategory
+	byId       map[int64]*db.VideoCategory
+	byName     map[string]*db.VideoCategory
+}
+
+func newRegistry(categories []db.VideoCategory) *Registry {
+	r := &Registry{
+		categories: categories,
+		byId:       map[int64]*db.VideoCategory{},
+		byName:     map[string]*db.VideoCategory{},
+	}
+	for i := range categories {
+		r.byId[categories[i].Id] = &categories[i]
+		r.byName[categories[i].Name] = &categories[i]
+	}
+	return r
+}
+
+// the registry as stored, or built from config.DefaultVideoCategories if no sync has run yet.
+func Load(context appengine.Context) (*Registry, error) {
+	var categories []db.VideoCategory
+	if _, err := memcache.Gob.Get(context, cacheKey, &categories); err == nil {
+		return newRegistry(categories), nil
+	} else if err != memcache.ErrCacheMiss {
+		context.Errorf("memcache error: %v", err)
+	}
+
+	categories, err := db.VideoCategories(context)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(categories) == 0 {
+		ids := []int{}
+		for id := range config.DefaultVideoCategories {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			categories = append(categories, db.VideoCategory{Id: int64(id), Name: config.DefaultVideoCategories[id]})
+		}
+	} else {
+		memcache.Gob.Set(context, &memcache.Item{
+			Key:        cacheKey,
+			Object:     categories,
+			Expiration: config.CategoryCacheTTL,
+		})
+	}
+
+	return newRegistry(categories), nil
+}
+
+// drop the cached registry after the stored one changes.
+func Invalidate(context appengine.Context) {
+	if err := memcache.Delete(context, cacheKey); err != nil && err != memcache.ErrCacheMiss {
+		context.Errorf("memcache error: %v", err)
+	}
+}
+
+// every category, including hidden ones.
+func (r *Registry) All() []db.VideoCategory {
+	return r.categories
+}
+
+// the categories clients should offer.
+func (r *Registry) Visible() []db.VideoCategory {
+	visible := []db.VideoCategory{}
+	for _, category := range r.categories {
+		if !category.Hidden {
+			visible = append(visible, category)
+		}
+	}
+	return visible
+}
+
+// a visible category by giantbomb id.
+func (r *Registry) ById(id int64) (*db.VideoCategory, bool) {
+	category, ok := r.byId[id]
+	if !ok || category.Hidden {
+		return nil, false
+	}
+	return category, true
+}
+
+// whether name is something a device can subscribe to.
+func (r *Registry) Subscribable(name string) bool {
+	if name == Live {
+		return true
+	}
+	category, ok := r.byName[name]
+	return ok && !category.Hidden
+}
+
+// the name clients should show for a category
+func DisplayName(category *db.VideoCategory) string {
+	if category.DisplayName != "" {
+		return category.DisplayName
+	}
+	return category.Name
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// headers clients identify themselves with
+const VersionHeader = "X-Luchadeer-Version"
+const PlatformHeader = "X-Luchadeer-Platform"
+const DeviceHeader = "X-Luchadeer-Device" // the device's push registration id
+const OSVersionHeader = "X-Luchadeer-OS-Version"
+const LocaleHeader = "X-Luchadeer-Locale" // falls back to Accept-Language
+const TimezoneHeader = "X-Luchadeer-Timezone"
+
+// longest os version, locale or timezone we keep. anything longer is cut.
+const maxDetailLength = 64
+
+const PlatformAndroid = "android"
+const PlatformIOS = "ios"
+
+// clients that don't say otherwise are the android client
+const DefaultPlatform = PlatformAndroid
+
+func KnownPlatform(platform string) bool {
+	return platform == PlatformAndroid || platform == PlatformIOS
+}
+
+// longest push token we accept. tokens are datastore key names, which can't be longer than 500 bytes.
+const MaxTokenLength = 500
+
+// whether token looks like a push token for platform. apns tokens are 32 bytes hex encoded, fcm tokens are opaque
+// but stick to url safe base64 and colons.
+func ValidToken(platform, token string) bool {
+	if token == "" || len(token) > MaxTokenLength {
+		return false
+	}
+
+	if platform == PlatformIOS {
+		if len(token) != 64 {
+			return false
+		}
+		_, err := hex.DecodeString(token)
+		return err == nil
+	}
+
+	for _, c := range token {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// a client version (major, minor, bugfix)
+type Version []int
+
+// parse a dotted version like 1.4.2. missing trailing parts are zero.
+func ParseVersion(s string) (Version, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("Bad version: %v", s)
+	}
+
+	v := Version{0, 0, 0}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Bad version: %v", s)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+func (v Version) Less(o Version) bool {
+	for i := 0; i < len(v) || i < len(o); i++ {
+		a, b := 0, 0
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(o) {
+			b = o[i]
+		}
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}
+
+func (v Version) String() string {
+	parts := make([]string, len(v))
+	for i, n := range v {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// what a request says about the client that sent it
+type Info struct {
+	Platform string
+	Version  Version // nil if the client didn't send one
+	Device   string  // empty if the client didn't send one
+
+	// free form details about the device, empty if the client didn't send them
+	OSVersion string
+	Locale    string
+	Timezone  string
+}
+
+// an error means the client sent a header we can't make sense of.
+func FromRequest(r *http.Request) (*Info, error) {
+	info := &Info{
+		Platform:  DefaultPlatform,
+		Device:    r.Header.Get(DeviceHeader),
+		OSVersion: detail(r.Header.Get(OSVersionHeader)),
+		Locale:    detail(r.Header.Get(LocaleHeader)),
+		Timezone:  detail(r.Header.Get(TimezoneHeader)),
+	}
+	if info.Locale == "" {
+		info.Locale = detail(firstLanguage(r.Header.Get("Accept-Language")))
+	}
+
+	if platform := r.Header.Get(PlatformHeader); platform != "" {
+		info.Platform = strings.ToLower(platform)
+	}
+
+	if version := r.Header.Get(VersionHeader); version != "" {
+		v, err := ParseVersion(version)
+		if err != nil {
+			return nil, err
+		}
+		info.Version = v
+	}
+
+	return info, nil
+}
+
+func detail(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) > maxDetailLength {
+		value = value[:maxDetailLength]
+	}
+	return value
+}
+
+// the first language tag of an Accept-Language header, without its weight
+func firstLanguage(header string) string {
+	tag := strings.SplitN(header, ",", 2)[0]
+	tag = strings.SplitN(tag, ";", 2)[0]
+	if tag == "*" {
+		return ""
+	}
+	return tag
+}
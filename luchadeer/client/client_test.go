@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Version
+	}{
+		{"1.4.2", Version{1, 4, 2}},
+		{"1.4", Version{1, 4, 0}},
+		{"2", Version{2, 0, 0}},
+		{"0.0.0", Version{0, 0, 0}},
+		{"10.20.30", Version{10, 20, 30}},
+		{"", nil},
+		{"1.2.3.4", nil},
+		{"1.x", nil},
+		{"1..2", nil},
+		{"-1.0", nil},
+		{"v1.0", nil},
+	}
+
+	for _, test := range tests {
+		got, err := ParseVersion(test.s)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("ParseVersion(%q) = %v, want an error", test.s, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseVersion(%q) = %v, %v, want %v", test.s, got, err, test.want)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		v, o Version
+		want bool
+	}{
+		{Version{1, 0, 0}, Version{1, 0, 1}, true},
+		{Version{1, 0, 1}, Version{1, 0, 0}, false},
+		{Version{1, 9, 9}, Version{2, 0, 0}, true},
+		{Version{1, 10, 0}, Version{1, 9, 0}, false},
+		{Version{1, 2, 3}, Version{1, 2, 3}, false},
+		{Version{1, 2}, Version{1, 2, 0}, false},
+		{Version{1, 2}, Version{1, 2, 1}, true},
+		{Version{1, 2, 1}, Version{1, 2}, false},
+		{nil, Version{0, 0, 1}, true},
+	}
+
+	for _, test := range tests {
+		if got := test.v.Less(test.o); got != test.want {
+			t.Errorf("%v.Less(%v) = %v, want %v", test.v, test.o, got, test.want)
+		}
+	}
+}
+
+func TestValidToken(t *testing.T) {
+	apns := strings.Repeat("0a1B", 16)
+	fcm := "dQw4w9WgXcQ:APA91bH-" + strings.Repeat("x_Y", 40)
+
+	tests := []struct {
+		platform string
+		token    string
+		want     bool
+	}{
+		{PlatformIOS, apns, true},
+		{PlatformIOS, apns[:62], false},
+		{PlatformIOS, apns + "00", false},
+		{PlatformIOS, strings.Repeat("zz", 32), false},
+		{PlatformIOS, "", false},
+		{PlatformAndroid, fcm, true},
+		{PlatformAndroid, apns, true},
+		{PlatformAndroid, "has space", false},
+		{PlatformAndroid, "slash/token", false},
+		{PlatformAndroid, "", false},
+		{PlatformAndroid, strings.Repeat("a", MaxTokenLength), true},
+		{PlatformAndroid, strings.Repeat("a", MaxTokenLength+1), false},
+	}
+
+	for _, test := range tests {
+		if got := ValidToken(test.platform, test.token); got != test.want {
+			t.Errorf("ValidToken(%v, %q) = %v, want %v", test.platform, test.token, got, test.want)
+		}
+	}
+}
+
+func TestFirstLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"en-US", "en-US"},
+		{"en-US,en;q=0.9", "en-US"},
+		{"fr-CA;q=0.8, en;q=0.5", "fr-CA"},
+		{"*", ""},
+		{"*;q=0.5", ""},
+		{"de", "de"},
+	}
+
+	for _, test := range tests {
+		if got := firstLanguage(test.header); got != test.want {
+			t.Errorf("firstLanguage(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
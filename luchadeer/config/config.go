@@ -42,8 +42,26 @@ const YouTubeSearchPath = "/youtube/v3/search"
 
 // api keys
 
-// cloud messaging api key. leave blank to not send push notifications
-const GCMApiKey = ""
+// firebase cloud messaging service account key file (json). leave blank to not push to android devices.
+const FCMServiceAccount = ""
+
+// only deliver android pushes to this app package. leave blank to not restrict.
+const AndroidPackageName = ""
+
+// validate pushes with the providers without delivering them
+const PushDryRun = false
+
+// how long alerts stay deliverable to devices that are offline. a live show alert is worthless once the stream
+// is over.
+const VideoAlertTTL = time.Hour * 24
+const LiveAlertTTL = time.Hour * 2
+
+// apple push notification service token auth. leave APNsPrivateKey blank to not push to ios devices.
+const APNsKeyId = ""
+const APNsTeamId = ""
+const APNsTopic = "" // the app's bundle id
+const APNsPrivateKey = ""
+const APNsProduction = true
 
 // giant bomb api keys
 
@@ -57,16 +75,113 @@ const ProxyApiKey = ""
 const YouTubeApiKey = ""
 const UnarchivedChannelId = ""
 
-// number of videos we check with each pull
-const VideoPullSize = 1
+// the pull pages through the newest videos until it finds one it has already seen, up to VideoPullMaxPages pages.
+// hitting the cap is logged as critical since videos may have been missed.
+const VideoPullPageSize = 25
+const VideoPullMaxPages = 4
+
+// pages the archive backfill may fetch per hour. giantbomb allows 200 requests per resource per hour, so leave
+// room for the regular pulls.
+const BackfillRequestsPerHour = 100
+
+// videos per backfill page. 100 is the api maximum.
+const BackfillPageSize = 100
+
+// the reconcile cron checks that videos published within this window still exist upstream, up to
+// ReconcileMaxVideos of them.
+const ReconcileWindow = time.Hour * 24 * 14
+const ReconcileMaxVideos = 500
+
+// send a data message with action=video_removed to subscribers when a video disappears upstream. only turn this
+// on once clients understand the action field, older ones will show it as a new video.
+const RemovalNoticesEnabled = false
+
+// pushes that fail for reasons on the provider's end are retried for the failed tokens only, up to PushMaxAttempts
+// sends in all. the wait doubles from PushRetryBaseDelay each attempt up to PushRetryMaxDelay, unless the provider
+// asked for longer with Retry-After.
+const PushMaxAttempts = 5
+const PushRetryBaseDelay = time.Second * 30
+const PushRetryMaxDelay = time.Hour
+
+// how long the push delivery ledger remembers a device was reached, and how many entries one prune run deletes.
+// the ledger only has to outlive a notification's retries.
+const PushLedgerTTL = time.Hour * 24 * 7
+const PushLedgerPruneBatch = 5000
+
+// how often a device that keeps reporting the same details has its last seen time written
+const DeviceSeenInterval = time.Hour
+
+// devices neither seen nor with their preferences updated within DeviceStaleAfter get a dry run push, and are
+// deleted if their token is dead. after DeviceExpireAfter they are deleted without asking. each prune run looks at
+// up to DevicePruneBatch stale preferences, and only reports what it would do while DevicePruneDryRun is on. dry
+// runs still work through every device, on a scan of their own.
+const DeviceStaleAfter = time.Hour * 24 * 60
+const DeviceExpireAfter = time.Hour * 24 * 365
+const DevicePruneBatch = 500
+const DevicePruneDryRun = true
+
+// largest preferences request body we read, and most categories one device may subscribe to
+const PreferencesMaxBytes = 16 * 1024
+const PreferencesMaxCategories = 100
+
+// most videos returned by one page of /api/1/videos
+const VideoQueryMaxLimit = 100
+
+// most stored videos a single /api/1/videos request will look at while filtering
+const VideoQueryMaxScan = 1000
+
+// most matches local video search looks at for each term. results come from the rarest group of terms, so this only
+// limits searches made entirely of common words. SearchMaxLimit is the most results per page.
+const SearchMaxMatches = 1000
+const SearchMaxLimit = 50
+
+// how long instances trust their copy of the video category registry
+const CategoryCacheTTL = time.Minute * 10
+
+// search suggestions are rebuilt by cron from the newest SuggestMaxVideos video names, up to SuggestMaxGames game
+// names seen while proxying and the SuggestMaxSearches most popular searches. instances reload them every
+// SuggestReloadInterval.
+const SuggestMaxVideos = 2000
+const SuggestMaxGames = 5000
+const SuggestMaxSearches = 2000
+const SuggestReloadInterval = time.Minute * 10
+
+// searches seen fewer times than this aren't suggested
+const SuggestMinSearchCount = 3
+
+// searches are counted in memcache and added to the stored counts at most this often per query
+const SearchCountFlushInterval = time.Minute * 5
+
+// most suggestions returned by /api/1/search/suggest
+const SuggestMaxLimit = 10
 
 // minimum client version before forcing an update (major, minor, bugfix)
 var MinVersion = []int{0, 0, 0}
 
+// per platform minimums, platforms not listed here use MinVersion
+var MinVersions = map[string][]int{
+	"android": {0, 0, 0},
+}
+
+// newest client version per platform, reported by /api/1/config
+var LatestVersions = map[string][]int{
+	"android": {0, 0, 0},
+}
+
+// treat clients that don't send a version header as outdated. old android clients never sent one.
+const RequireVersionHeader = false
+
+// api paths that keep working for outdated clients, so they can still manage their notifications
+var VersionExemptPaths = []string{
+	"/api/1/preferences",
+	"/api/1/config",
+}
+
 // redirect from /
 const ClientDownloadURL = ""
 
-var ValidVideoCategories = map[int]string{
+// video categories to use until the first video type sync has run. after that they come from giantbomb.
+var DefaultVideoCategories = map[int]string{
 	2:  "Reviews",
 	3:  "Quick Looks",
 	4:  "TANG",
@@ -84,6 +199,20 @@ var ValidVideoCategories = map[int]string{
 const ProxyRequests = true
 const SearchProxyEnabled = true
 
+// features reported to clients by /api/1/config
+var Features = map[string]bool{
+	"local_videos":   true,
+	"local_search":   true,
+	"search_suggest": true,
+	"slim_responses": true,
+}
+
+// how long instances trust their copy of the feature flags
+const FlagCacheTTL = time.Minute
+
+// how long /api/1/config responses are cached
+const ClientConfigCacheTTL = time.Minute * 10
+
 const DefaultCacheTTL = time.Hour * 24
 
 const ListRequestCacheTTL = time.Hour
@@ -92,3 +221,6 @@ const GameDetailCacheTTL = time.Hour * 24
 const VideoDetailCacheTTL = time.Hour * 24 * 7
 
 const BadRequestCacheTTL = time.Hour
+
+// proxied responses larger than this are streamed to the client but not cached. memcache values top out at 1MB.
+const ProxyCacheMaxBytes = 1000 * 1000
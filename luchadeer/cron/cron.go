@@ -32,47 +32,324 @@ package cron
 
 import (
 	"appengine"
+	"fmt"
+	"luchadeer/categories"
 	"luchadeer/config"
 	"luchadeer/db"
 	"luchadeer/giantbomb"
+	"luchadeer/search"
 	"luchadeer/tasks"
+	"math"
 	"net/http"
+	"time"
 )
 
 const PullVideosURL = "/cron/pull_videos"
 const PollChatURL = "/cron/poll_chat"
+const ReconcileVideosURL = "/cron/reconcile_videos"
+const RebuildSuggestionsURL = "/cron/rebuild_suggestions"
+const SyncVideoTypesURL = "/cron/sync_video_types"
+const PrunePushDeliveriesURL = "/cron/prune_push_deliveries"
+const PruneDevicesURL = "/cron/prune_devices"
 
 func Init() {
 	http.HandleFunc(PullVideosURL, pullVideos)
 	http.HandleFunc(PollChatURL, pollChat)
+	http.HandleFunc(ReconcileVideosURL, reconcileVideos)
+	http.HandleFunc(RebuildSuggestionsURL, rebuildSuggestions)
+	http.HandleFunc(SyncVideoTypesURL, syncVideoTypes)
+	http.HandleFunc(PrunePushDeliveriesURL, prunePushDeliveries)
+	http.HandleFunc(PruneDevicesURL, pruneDevices)
 }
 
+// page through the newest videos until we reach the high-water mark from the last pull, store whatever is new and
+// push alerts for it.
 func pullVideos(w http.ResponseWriter, r *http.Request) {
 	context := appengine.NewContext(r)
 
-	response, err := giantbomb.GetVideos(context, nil, 0, config.VideoPullSize)
+	state, err := db.GetVideoSyncState(context)
 	if err != nil {
+		context.Errorf("GetVideoSyncState: %v", err)
+		return
+	}
+
+	mark := state.HighWaterMark
+	if mark == 0 {
+		// first pull since the mark was introduced, start from what we have.
+		if mark, err = db.NewestVideoId(context); err != nil {
+			context.Errorf("NewestVideoId: %v", err)
+			return
+		}
+	}
+
+	videos, reached, err := pullVideosSince(context, mark)
+	if err != nil {
+		// leave the mark alone so the next run covers this one
 		context.Errorf("Video pull failed: %v", err)
 		return
 	}
 
-	videos := response.Results
+	if !reached && mark > 0 {
+		// anything between the oldest video we saw and the mark was never fetched.
+		oldest := videos[len(videos)-1].Id
+		context.Criticalf("Video pull hit the cap of %v pages without reaching video %v, videos between %v and %v may be missing",
+			config.VideoPullMaxPages, mark, mark, oldest)
+		state.GapFound = time.Now()
+		state.GapAfterId = mark
+		state.GapBeforeId = oldest
+	}
+
+	for _, video := range videos {
+		if video.Id > state.HighWaterMark {
+			state.HighWaterMark = video.Id
+		}
+	}
 
-	newVideos, err := db.PutNewVideos(context, videos)
+	newVideos, revisions, err := db.SyncVideos(context, videos)
 	if err != nil {
-		context.Errorf("PutNewVideos error: %v", err)
+		context.Errorf("SyncVideos error: %v", err)
 		return
 	}
 
-	context.Infof("Video pull: Pulled: %v, New: %v", len(videos), len(newVideos))
-	if len(newVideos) > 0 {
+	context.Infof("Video pull: Pulled: %v, New: %v, Changed: %v", len(videos), len(newVideos), len(revisions))
+	for _, revision := range revisions {
+		context.Infof("Changed video %v: %v", revision.VideoId, revision.Changes)
+	}
+
+	if mark == 0 {
+		// empty store. don't alert everyone about a page of old videos.
+		context.Infof("Video pull: seeded store with %v videos", len(newVideos))
+	} else if len(newVideos) > 0 {
 		for _, video := range newVideos {
+			// the rest of the mark's page comes back too. anything at or below the mark isn't news.
+			if video.Id <= mark {
+				context.Infof("Stored old video: %v", video)
+				continue
+			}
+
 			context.Infof("New video: %v", video)
 			tasks.PushAlertsForVideo(context, video)
 		}
 
 		// TODO: invalidate list caches
 	}
+
+	if err := db.PutVideoSyncState(context, state); err != nil {
+		context.Errorf("PutVideoSyncState: %v", err)
+	}
+}
+
+// fetch videos newer than mark, newest first, along with the rest of the page the mark turned up on so already
+// stored videos get checked for changes. reached is false if the page cap ran out first. with no mark only the
+// first page is fetched.
+func pullVideosSince(context appengine.Context, mark int64) (videos []giantbomb.Video, reached bool, err error) {
+	for page := 0; page < config.VideoPullMaxPages; page++ {
+		response, err := giantbomb.GetVideos(context, nil, page*config.VideoPullPageSize, config.VideoPullPageSize, giantbomb.SortNewest)
+		if err != nil {
+			return nil, false, err
+		}
+		if response.StatusCode != giantbomb.StatusOK {
+			return nil, false, fmt.Errorf("Bad status returned by content provider: %v: %v", response.StatusCode, response.Error)
+		}
+
+		for _, video := range response.Results {
+			if video.Id <= mark {
+				reached = true
+			}
+		}
+		videos = append(videos, response.Results...)
+
+		if reached || mark == 0 || len(response.Results) < config.VideoPullPageSize {
+			return videos, true, nil
+		}
+	}
+
+	return videos, false, nil
+}
+
+// check that recently published videos still exist upstream and tombstone the ones that don't.
+func reconcileVideos(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	videos, err := db.RecentVideos(context, time.Now().Add(-config.ReconcileWindow), config.ReconcileMaxVideos)
+	if err != nil {
+		context.Errorf("RecentVideos: %v", err)
+		return
+	}
+
+	removed := []giantbomb.Video{}
+	for off := 0; off < len(videos); off += 100 {
+		max := off + 100
+		if max > len(videos) {
+			max = len(videos)
+		}
+		batch := videos[off:max]
+
+		ids := make([]int64, len(batch))
+		for i, video := range batch {
+			ids[i] = video.Id
+		}
+
+		response, err := giantbomb.GetVideosById(context, ids)
+		if err == nil && response.StatusCode != giantbomb.StatusOK {
+			err = fmt.Errorf("Bad status returned by content provider: %v: %v", response.StatusCode, response.Error)
+		}
+		if err != nil {
+			context.Errorf("Reconcile fetch failed (%v-%v): %v", off, max, err)
+			continue
+		}
+
+		if len(response.Results) == 0 {
+			// a whole batch vanishing is far more likely to be an api problem than a purge.
+			context.Warningf("Reconcile got nothing back for %v videos, skipping them", len(batch))
+			continue
+		}
+
+		found := map[int64]bool{}
+		for _, video := range response.Results {
+			found[video.Id] = true
+		}
+		for _, video := range batch {
+			if !found[video.Id] {
+				removed = append(removed, video)
+			}
+		}
+	}
+
+	context.Infof("Reconcile: Checked: %v, Removed: %v", len(videos), len(removed))
+	if len(removed) == 0 {
+		return
+	}
+
+	if err := db.TombstoneVideos(context, removed); err != nil {
+		context.Errorf("TombstoneVideos: %v", err)
+		return
+	}
+
+	for _, video := range removed {
+		context.Infof("Removed video: %v", video)
+		if config.RemovalNoticesEnabled {
+			tasks.PushRemovalForVideo(context, &video)
+		}
+	}
+}
+
+// rank video names, game names and popular searches into the snapshot the suggest endpoint serves from. text that
+// turns up from more than one source adds up. searches are only suggested if every word of them turns up in a video
+// or game name, which keeps typos and anything nasty people search for out.
+func rebuildSuggestions(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	videos, err := db.NewestVideos(context, config.SuggestMaxVideos)
+	if err != nil {
+		context.Errorf("NewestVideos: %v", err)
+		return
+	}
+	games, err := db.SuggestionSources(context, db.SUGGESTION_SOURCE_GAME, config.SuggestMaxGames)
+	if err != nil {
+		context.Errorf("SuggestionSources games: %v", err)
+		return
+	}
+	searches, err := db.SuggestionSources(context, db.SUGGESTION_SOURCE_SEARCH, config.SuggestMaxSearches)
+	if err != nil {
+		context.Errorf("SuggestionSources searches: %v", err)
+		return
+	}
+
+	suggestions := []search.Suggestion{}
+	index := map[string]int{}
+	add := func(text string, score float64) {
+		normalized := search.Normalize(text)
+		if normalized == "" {
+			return
+		}
+		if i, ok := index[normalized]; ok {
+			suggestions[i].Score += score
+			return
+		}
+		index[normalized] = len(suggestions)
+		suggestions = append(suggestions, search.Suggestion{Text: text, Score: score})
+	}
+
+	// newer videos rank higher
+	for i, video := range videos {
+		add(video.Name, 2-float64(i)/float64(len(videos)))
+	}
+	for _, game := range games {
+		add(game.Text, 1)
+	}
+	vocabulary := search.Vocabulary{}
+	for _, video := range videos {
+		vocabulary.Add(video.Name)
+	}
+	for _, game := range games {
+		vocabulary.Add(game.Text)
+	}
+
+	dropped := 0
+	for _, query := range searches {
+		if !vocabulary.Covers(query.Text) {
+			dropped++
+			continue
+		}
+		if query.Count >= config.SuggestMinSearchCount {
+			add(query.Text, 1+math.Log(float64(query.Count)))
+		}
+	}
+
+	if err := db.PutSuggestionSnapshot(context, suggestions); err != nil {
+		context.Errorf("PutSuggestionSnapshot: %v", err)
+		return
+	}
+
+	context.Infof("Rebuilt suggestions: Videos: %v, Games: %v, Searches: %v, Dropped searches: %v, Total: %v",
+		len(videos), len(games), len(searches), dropped, len(suggestions))
+}
+
+// keep the video category registry in line with giantbomb's video types.
+func syncVideoTypes(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	response, err := giantbomb.GetVideoTypes(context)
+	if err == nil && response.StatusCode != giantbomb.StatusOK {
+		err = fmt.Errorf("Bad status returned by content provider: %v: %v", response.StatusCode, response.Error)
+	}
+	if err != nil {
+		context.Errorf("Video type sync failed: %v", err)
+		return
+	}
+
+	if err := db.SyncVideoCategories(context, response.Results); err != nil {
+		context.Errorf("SyncVideoCategories: %v", err)
+		return
+	}
+	categories.Invalidate(context)
+
+	context.Infof("Video type sync: %v types", len(response.Results))
+}
+
+// the delivery ledger only has to outlive retries, so old entries are dropped a batch at a time
+func prunePushDeliveries(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	pruned, err := db.PrunePushDeliveries(context, time.Now().Add(-config.PushLedgerTTL), config.PushLedgerPruneBatch)
+	if err != nil {
+		context.Errorf("PrunePushDeliveries: %v", err)
+	}
+	context.Infof("Pruned %v push deliveries", pruned)
+}
+
+func pruneDevices(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	report, err := tasks.PruneDevices(context, config.DevicePruneDryRun)
+	if err != nil {
+		context.Errorf("PruneDevices: %v", err)
+		return
+	}
+	context.Infof("Device prune (dry run %v): scanned %v, active %v, checked %v, alive %v, format only %v, skipped %v, deleted %v",
+		report.DryRun, report.Scanned, report.Active, report.Checked, report.Alive, report.FormatOnly, report.Skipped,
+		report.Deleted)
 }
 
 func pollChat(w http.ResponseWriter, r *http.Request) {
@@ -83,11 +360,11 @@ func pollChat(w http.ResponseWriter, r *http.Request) {
 		context.Infof("pollChat: %v", err)
 		return
 	}
-	_, perr := db.PutChat(context, title)
+	chat, perr := db.PutChat(context, title)
 	if perr != nil {
 		context.Infof("PutChat: %v", perr)
 		return
 	}
 
-	tasks.PushAlertForChat(context, title)
+	tasks.PushAlertForChat(context, chat)
 }
@@ -33,38 +33,759 @@ package db
 import (
 	"appengine"
 	"appengine/datastore"
+	"encoding/json"
 	"errors"
+	"luchadeer/client"
+	"luchadeer/config"
 	"luchadeer/giantbomb"
+	"luchadeer/search"
+	"sort"
+	"strconv"
 	"time"
 )
 
 type NotificationPreference struct {
-	GCMRegistrationId string   `json:"gcm_registration_id"`
-	Categories        []string `json:"categories"`
-	LastUpdated       time.Time
+	GCMRegistrationId string    `json:"gcm_registration_id"` // the push token, whatever the platform
+	Categories        []string  `json:"categories"`
+	Platform          string    `json:"platform"`
+	LastUpdated       time.Time `json:"last_updated"`
+}
+
+// preferences from before Platform was stored are all android
+func (p *NotificationPreference) DevicePlatform() string {
+	if p.Platform == "" {
+		return client.PlatformAndroid
+	}
+	return p.Platform
 }
 
 const KIND_NOTIFICATION_SUBSCRIPTION = "notificationpreference"
+const KIND_DEVICE = "device"
 const KIND_GIANT_BOMB_VIDEO = "giantbombvideo"
+const KIND_GIANT_BOMB_VIDEO_REVISION = "giantbombvideorevision"
 const KIND_GIANT_BOMB_CHAT = "giantbombchat"
+const KIND_BACKFILL_STATE = "backfillstate"
+const KIND_SYNC_STATE = "syncstate"
+const KIND_SUGGESTION_SOURCE = "suggestionsource"
+const KIND_SUGGESTION_SNAPSHOT = "suggestionsnapshot"
+const KIND_VIDEO_CATEGORY = "videocategory"
+const KIND_FEATURE_FLAG = "featureflag"
+const KIND_PUSH_NOTIFICATION = "pushnotification"
+const KIND_PUSH_PAGE = "pushpage"
+const KIND_PUSH_DELIVERY = "pushdelivery"
+
+var ErrChatRecorded = errors.New("Chat is already recorded")
 
 func UpdateNotificationPreference(context appengine.Context, preference *NotificationPreference) error {
-	key := datastore.NewKey(context, KIND_NOTIFICATION_SUBSCRIPTION, preference.GCMRegistrationId, 0, nil)
+	key := notificationPreferenceKey(context, preference.GCMRegistrationId)
 	preference.LastUpdated = time.Now()
 	_, err := datastore.Put(context, key, preference)
 
 	return err
 }
 
-func NotificationSubscriptions(context appengine.Context, category string) ([]NotificationPreference, error) {
-	var preferences []NotificationPreference
-	query := datastore.NewQuery(KIND_NOTIFICATION_SUBSCRIPTION).Filter("Categories =", category)
-	if _, err := query.GetAll(context, &preferences); err != nil {
+func notificationPreferenceKey(context appengine.Context, token string) *datastore.Key {
+	return datastore.NewKey(context, KIND_NOTIFICATION_SUBSCRIPTION, token, 0, nil)
+}
+
+func GetNotificationPreference(context appengine.Context, token string) (*NotificationPreference, error) {
+	var preference NotificationPreference
+	if err := datastore.Get(context, notificationPreferenceKey(context, token), &preference); err != nil {
+		return nil, err
+	}
+	return &preference, nil
+}
+
+// change the stored preference for token in a transaction. ErrNoSuchEntity if there isn't one, and an error from
+// update leaves it as it was.
+func PatchNotificationPreference(context appengine.Context, token string, update func(*NotificationPreference) error) (*NotificationPreference, error) {
+	var preference NotificationPreference
+	err := datastore.RunInTransaction(context, func(context appengine.Context) error {
+		key := notificationPreferenceKey(context, token)
+		if err := datastore.Get(context, key, &preference); err != nil {
+			return err
+		}
+		if err := update(&preference); err != nil {
+			return err
+		}
+		preference.LastUpdated = time.Now()
+		_, err := datastore.Put(context, key, &preference)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &preference, nil
+}
+
+// a device that has talked to us, keyed by its push token. its NotificationPreference has the same key name, so
+// the two are looked up, moved and deleted together.
+type Device struct {
+	Token      string    `json:"token" datastore:"-"`
+	Platform   string    `json:"platform"`
+	AppVersion string    `json:"app_version"`
+	OSVersion  string    `json:"os_version" datastore:",noindex"`
+	Locale     string    `json:"locale"`
+	Timezone   string    `json:"timezone" datastore:",noindex"`
+	Created    time.Time `json:"created"`
+	LastSeen   time.Time `json:"last_seen"`
+	Checked    time.Time `json:"checked" datastore:",noindex"` // last time a prune found the token still good
+}
+
+func deviceKey(context appengine.Context, token string) *datastore.Key {
+	return datastore.NewKey(context, KIND_DEVICE, token, 0, nil)
+}
+
+// record that seen was seen just now. empty fields of seen keep what's stored.
+func TouchDevice(context appengine.Context, seen *Device) (*Device, error) {
+	var device Device
+	err := datastore.RunInTransaction(context, func(context appengine.Context) error {
+		key := deviceKey(context, seen.Token)
+		if err := datastore.Get(context, key, &device); err == datastore.ErrNoSuchEntity {
+			device = Device{Created: time.Now()}
+		} else if err != nil {
+			return err
+		}
+
+		updateField(&device.Platform, seen.Platform)
+		updateField(&device.AppVersion, seen.AppVersion)
+		updateField(&device.OSVersion, seen.OSVersion)
+		updateField(&device.Locale, seen.Locale)
+		updateField(&device.Timezone, seen.Timezone)
+		device.LastSeen = time.Now()
+
+		_, err := datastore.Put(context, key, &device)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	device.Token = seen.Token
+	return &device, nil
+}
+
+func updateField(stored *string, seen string) {
+	if seen != "" {
+		*stored = seen
+	}
+}
+
+func GetDevice(context appengine.Context, token string) (*Device, error) {
+	var device Device
+	if err := datastore.Get(context, deviceKey(context, token), &device); err != nil {
 		return nil, err
 	}
+	device.Token = token
+	return &device, nil
+}
+
+// the devices for tokens, by token. tokens without one are left out.
+func GetDevices(context appengine.Context, tokens []string) (map[string]*Device, error) {
+	devices := map[string]*Device{}
+	for off := 0; off < len(tokens); off += multiLimit {
+		max := off + multiLimit
+		if max > len(tokens) {
+			max = len(tokens)
+		}
+
+		keys := make([]*datastore.Key, max-off)
+		for i, token := range tokens[off:max] {
+			keys[i] = deviceKey(context, token)
+		}
+
+		found := make([]Device, len(keys))
+		errs := make(appengine.MultiError, len(keys))
+		if err := datastore.GetMulti(context, keys, found); err != nil {
+			me, ok := err.(appengine.MultiError)
+			if !ok {
+				return nil, err
+			}
+			errs = me
+		}
+		for i := range found {
+			if errs[i] == nil {
+				found[i].Token = tokens[off+i]
+				devices[found[i].Token] = &found[i]
+			} else if errs[i] != datastore.ErrNoSuchEntity {
+				return nil, errs[i]
+			}
+		}
+	}
+	return devices, nil
+}
+
+// the preferences for tokens, by token. tokens without one are left out.
+func GetNotificationPreferences(context appengine.Context, tokens []string) (map[string]*NotificationPreference, error) {
+	preferences := map[string]*NotificationPreference{}
+	for off := 0; off < len(tokens); off += multiLimit {
+		max := off + multiLimit
+		if max > len(tokens) {
+			max = len(tokens)
+		}
+
+		keys := make([]*datastore.Key, max-off)
+		for i, token := range tokens[off:max] {
+			keys[i] = notificationPreferenceKey(context, token)
+		}
+
+		found := make([]NotificationPreference, len(keys))
+		errs := make(appengine.MultiError, len(keys))
+		if err := datastore.GetMulti(context, keys, found); err != nil {
+			me, ok := err.(appengine.MultiError)
+			if !ok {
+				return nil, err
+			}
+			errs = me
+		}
+		for i := range found {
+			if errs[i] == nil {
+				preferences[tokens[off+i]] = &found[i]
+			} else if errs[i] != datastore.ErrNoSuchEntity {
+				return nil, errs[i]
+			}
+		}
+	}
 	return preferences, nil
 }
 
+// preferences not updated since before, oldest first, from cursor. the next cursor is empty at the end.
+func StalePreferences(context appengine.Context, before time.Time, cursor string, limit int) ([]NotificationPreference, string, error) {
+	query := datastore.NewQuery(KIND_NOTIFICATION_SUBSCRIPTION).Filter("LastUpdated <", before).Order("LastUpdated")
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(c)
+	}
+
+	preferences := []NotificationPreference{}
+	iterator := query.Run(context)
+	for len(preferences) < limit {
+		var preference NotificationPreference
+		_, err := iterator.Next(&preference)
+		if err == datastore.Done {
+			return preferences, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		preferences = append(preferences, preference)
+	}
+
+	next, err := iterator.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return preferences, next.String(), nil
+}
+
+// up to limit devices not seen since before, oldest first
+func StaleDevices(context appengine.Context, before time.Time, limit int) ([]Device, error) {
+	devices := []Device{}
+	query := datastore.NewQuery(KIND_DEVICE).Filter("LastSeen <", before).Order("LastSeen").Limit(limit)
+	keys, err := query.GetAll(context, &devices)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		devices[i].Token = key.StringID()
+	}
+	return devices, nil
+}
+
+// record that tokens passed a prune check. tokens from before devices were recorded get a device made for them.
+func MarkDevicesChecked(context appengine.Context, tokens []string, platforms map[string]string) error {
+	devices, err := GetDevices(context, tokens)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for off := 0; off < len(tokens); off += multiLimit {
+		max := off + multiLimit
+		if max > len(tokens) {
+			max = len(tokens)
+		}
+
+		keys := make([]*datastore.Key, max-off)
+		checked := make([]Device, max-off)
+		for i, token := range tokens[off:max] {
+			keys[i] = deviceKey(context, token)
+			if device, ok := devices[token]; ok {
+				checked[i] = *device
+			} else {
+				checked[i] = Device{Platform: platforms[token], Created: now}
+			}
+			checked[i].Checked = now
+		}
+		if _, err := datastore.PutMulti(context, keys, checked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// where a stale device scan left off. StaleBefore is fixed when a scan starts so the cursor stays valid for the
+// query it came from.
+type DevicePruneState struct {
+	Cursor      string `datastore:",noindex"`
+	StaleBefore time.Time
+	Updated     time.Time
+}
+
+// dry runs keep their own scan so they never move the real one on
+func devicePruneStateKey(context appengine.Context, dryRun bool) *datastore.Key {
+	if dryRun {
+		return datastore.NewKey(context, KIND_SYNC_STATE, "devices-dry-run", 0, nil)
+	}
+	return datastore.NewKey(context, KIND_SYNC_STATE, "devices", 0, nil)
+}
+
+// returns a zero state if the prune has never recorded one.
+func GetDevicePruneState(context appengine.Context, dryRun bool) (*DevicePruneState, error) {
+	var state DevicePruneState
+	if err := datastore.Get(context, devicePruneStateKey(context, dryRun), &state); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func PutDevicePruneState(context appengine.Context, dryRun bool, state *DevicePruneState) error {
+	state.Updated = time.Now()
+	_, err := datastore.Put(context, devicePruneStateKey(context, dryRun), state)
+	return err
+}
+
+// forget devices and their preferences, e.g. when the push provider says the tokens are dead
+func DeleteDevices(context appengine.Context, tokens []string) error {
+	keys := make([]*datastore.Key, 0, len(tokens)*2)
+	for _, token := range tokens {
+		keys = append(keys, deviceKey(context, token), notificationPreferenceKey(context, token))
+	}
+	for off := 0; off < len(keys); off += multiLimit {
+		max := off + multiLimit
+		if max > len(keys) {
+			max = len(keys)
+		}
+		if err := datastore.DeleteMulti(context, keys[off:max]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move the device and preference for token over to canonical. if the device already registered under canonical as
+// well, the categories of both are kept.
+func ReplaceNotificationToken(context appengine.Context, token, canonical string) error {
+	if token == canonical {
+		return nil
+	}
+
+	return datastore.RunInTransaction(context, func(context appengine.Context) error {
+		oldKey := notificationPreferenceKey(context, token)
+		newKey := notificationPreferenceKey(context, canonical)
+
+		var old NotificationPreference
+		if err := datastore.Get(context, oldKey, &old); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var replacement NotificationPreference
+		if err := datastore.Get(context, newKey, &replacement); err == datastore.ErrNoSuchEntity {
+			replacement = old
+		} else if err != nil {
+			return err
+		} else {
+			replacement.Categories = mergeCategories(replacement.Categories, old.Categories)
+		}
+
+		replacement.GCMRegistrationId = canonical
+		replacement.LastUpdated = time.Now()
+		if _, err := datastore.Put(context, newKey, &replacement); err != nil {
+			return err
+		}
+		if err := datastore.Delete(context, oldKey); err != nil {
+			return err
+		}
+
+		// the device under canonical wins if there is one, it was registered more recently
+		oldDeviceKey := deviceKey(context, token)
+		newDeviceKey := deviceKey(context, canonical)
+		var device Device
+		if err := datastore.Get(context, oldDeviceKey, &device); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var existing Device
+		if err := datastore.Get(context, newDeviceKey, &existing); err == datastore.ErrNoSuchEntity {
+			if _, err := datastore.Put(context, newDeviceKey, &device); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		return datastore.Delete(context, oldDeviceKey)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+func mergeCategories(a, b []string) []string {
+	merged := append([]string{}, a...)
+	seen := map[string]bool{}
+	for _, category := range a {
+		seen[category] = true
+	}
+	for _, category := range b {
+		if !seen[category] {
+			seen[category] = true
+			merged = append(merged, category)
+		}
+	}
+	return merged
+}
+
+// the keys of subscribers to category between the start and end cursors, up to limit of them if limit is positive.
+// keys only queries are cheap enough to walk a big category with, and a page is fetched with the same query so its
+// cursors hold.
+func subscriptionKeys(context appengine.Context, category, start, end string, limit int) ([]*datastore.Key, string, error) {
+	query := datastore.NewQuery(KIND_NOTIFICATION_SUBSCRIPTION).Filter("Categories =", category).KeysOnly()
+	if start != "" {
+		c, err := datastore.DecodeCursor(start)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(c)
+	}
+	if end != "" {
+		c, err := datastore.DecodeCursor(end)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.End(c)
+	}
+
+	var keys []*datastore.Key
+	iterator := query.Run(context)
+	for limit <= 0 || len(keys) < limit {
+		key, err := iterator.Next(nil)
+		if err == datastore.Done {
+			return keys, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		keys = append(keys, key)
+	}
+
+	next, err := iterator.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, next.String(), nil
+}
+
+// skip limit subscribers to category from cursor. returns the cursor after them, empty at the end, and how many
+// were skipped.
+func SkipNotificationSubscriptions(context appengine.Context, category, cursor string, limit int) (string, int, error) {
+	keys, next, err := subscriptionKeys(context, category, cursor, "", limit)
+	return next, len(keys), err
+}
+
+// the page of subscribers to category between the start and end cursors a walk found. an empty end runs to the last
+// subscriber. the end cursor bounds the page rather than a count, so subscribers added or removed since the walk
+// can't shift it into the next page.
+func NotificationSubscriptionsPage(context appengine.Context, category, start, end string) ([]NotificationPreference, error) {
+	keys, _, err := subscriptionKeys(context, category, start, end, 0)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	// subscribers added since the walk can grow a page, so it's fetched in batches
+	preferences := []NotificationPreference{}
+	for off := 0; off < len(keys); off += multiLimit {
+		max := off + multiLimit
+		if max > len(keys) {
+			max = len(keys)
+		}
+
+		batch := make([]NotificationPreference, max-off)
+		err := datastore.GetMulti(context, keys[off:max], batch)
+		me, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			return nil, err
+		}
+		for i := range batch {
+			// preferences deleted since the page was walked are skipped
+			if ok && me[i] == datastore.ErrNoSuchEntity {
+				continue
+			} else if ok && me[i] != nil {
+				return nil, me[i]
+			}
+			preferences = append(preferences, batch[i])
+		}
+	}
+	return preferences, nil
+}
+
+// one fan out of a push to every subscriber of a category. pages of subscribers are sent by their own tasks, and
+// each records a PushPage when it's done. keys are derived from what the push is about, e.g. video-1234, so the same
+// thing can't be pushed twice.
+type PushNotification struct {
+	Key      string    `json:"key" datastore:"-"`
+	Category string    `json:"category"`
+	Message  []byte    `json:"-" datastore:",noindex"` // json push.Message
+	Created  time.Time `json:"created"`
+	Walked   bool      `json:"walked"` // every page has been queued, so Pages is final
+	Pages    int       `json:"pages"`
+	Finished time.Time `json:"finished"` // when the last page was sent. Stats are the totals from then on.
+	PushStats
+}
+
+// how sending went, for a page or a whole notification
+type PushStats struct {
+	Devices   int `json:"devices" datastore:",noindex"`
+	Success   int `json:"success" datastore:",noindex"`
+	Failure   int `json:"failure" datastore:",noindex"`
+	Canonical int `json:"canonical" datastore:",noindex"`
+	Removed   int `json:"removed" datastore:",noindex"`
+	Replaced  int `json:"replaced" datastore:",noindex"`
+	Retried   int `json:"retried" datastore:",noindex"`
+}
+
+func (s *PushStats) Add(other *PushStats) {
+	s.Devices += other.Devices
+	s.Success += other.Success
+	s.Failure += other.Failure
+	s.Canonical += other.Canonical
+	s.Removed += other.Removed
+	s.Replaced += other.Replaced
+	s.Retried += other.Retried
+}
+
+type PushPage struct {
+	Notification string    `json:"notification"`
+	Page         int       `json:"page"`
+	Completed    time.Time `json:"completed"`
+	PushStats
+}
+
+func pushNotificationKey(context appengine.Context, key string) *datastore.Key {
+	return datastore.NewKey(context, KIND_PUSH_NOTIFICATION, key, 0, nil)
+}
+
+// pages are root entities so parallel pages don't contend on one entity group
+func pushPageKey(context appengine.Context, notification string, page int) *datastore.Key {
+	return datastore.NewKey(context, KIND_PUSH_PAGE, notification+"-"+strconv.Itoa(page), 0, nil)
+}
+
+// store notification unless one with its key exists. returns whether it was stored.
+func CreatePushNotification(context appengine.Context, notification *PushNotification) (bool, error) {
+	created := false
+	err := datastore.RunInTransaction(context, func(context appengine.Context) error {
+		key := pushNotificationKey(context, notification.Key)
+		var existing PushNotification
+		if err := datastore.Get(context, key, &existing); err == nil {
+			created = false
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		created = true
+		_, err := datastore.Put(context, key, notification)
+		return err
+	}, nil)
+	return created, err
+}
+
+func PutPushNotification(context appengine.Context, notification *PushNotification) error {
+	_, err := datastore.Put(context, pushNotificationKey(context, notification.Key), notification)
+	return err
+}
+
+func GetPushNotification(context appengine.Context, key string) (*PushNotification, error) {
+	var notification PushNotification
+	if err := datastore.Get(context, pushNotificationKey(context, key), &notification); err != nil {
+		return nil, err
+	}
+	notification.Key = key
+	return &notification, nil
+}
+
+func PutPushPage(context appengine.Context, page *PushPage) error {
+	page.Completed = time.Now()
+	_, err := datastore.Put(context, pushPageKey(context, page.Notification, page.Page), page)
+	return err
+}
+
+// notifications newest first, optionally only those to category
+func RecentPushNotifications(context appengine.Context, category, cursor string, limit int) ([]PushNotification, string, error) {
+	query := datastore.NewQuery(KIND_PUSH_NOTIFICATION).Order("-Created")
+	if category != "" {
+		query = query.Filter("Category =", category)
+	}
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(c)
+	}
+
+	notifications := []PushNotification{}
+	iterator := query.Run(context)
+	for len(notifications) < limit {
+		var notification PushNotification
+		key, err := iterator.Next(&notification)
+		if err == datastore.Done {
+			return notifications, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		notification.Key = key.StringID()
+		notifications = append(notifications, notification)
+	}
+
+	next, err := iterator.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return notifications, next.String(), nil
+}
+
+// the pages of notification that have been sent so far
+func PushPages(context appengine.Context, notification string) ([]PushPage, error) {
+	pages := []PushPage{}
+	query := datastore.NewQuery(KIND_PUSH_PAGE).Filter("Notification =", notification)
+	if _, err := query.GetAll(context, &pages); err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// the first pages pages of notification, skipping any not sent yet. unlike PushPages this gets them by key, so a
+// page that was just put is always seen.
+func GetPushPages(context appengine.Context, notification string, pages int) ([]PushPage, error) {
+	keys := make([]*datastore.Key, pages)
+	for i := range keys {
+		keys[i] = pushPageKey(context, notification, i)
+	}
+
+	found := []PushPage{}
+	for start := 0; start < len(keys); start += multiLimit {
+		end := start + multiLimit
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := make([]PushPage, end-start)
+		err := datastore.GetMulti(context, keys[start:end], batch)
+		me, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			return nil, err
+		}
+		for i := range batch {
+			if ok && me[i] == datastore.ErrNoSuchEntity {
+				continue
+			} else if ok && me[i] != nil {
+				return nil, me[i]
+			}
+			found = append(found, batch[i])
+		}
+	}
+	return found, nil
+}
+
+// the ledger of which devices a notification has reached, so retried tasks never push a device twice
+type PushDelivery struct {
+	Notification string
+	Delivered    time.Time
+}
+
+// batch limit for PutMulti and DeleteMulti
+const multiLimit = 500
+
+func pushDeliveryKey(context appengine.Context, notification, token string) *datastore.Key {
+	return datastore.NewKey(context, KIND_PUSH_DELIVERY, notification+"/"+token, 0, nil)
+}
+
+// the tokens notification hasn't been delivered to
+func UndeliveredTokens(context appengine.Context, notification string, tokens []string) ([]string, error) {
+	undelivered := []string{}
+	for off := 0; off < len(tokens); off += multiLimit {
+		max := off + multiLimit
+		if max > len(tokens) {
+			max = len(tokens)
+		}
+
+		keys := make([]*datastore.Key, max-off)
+		for i, token := range tokens[off:max] {
+			keys[i] = pushDeliveryKey(context, notification, token)
+		}
+
+		deliveries := make([]PushDelivery, len(keys))
+		err := datastore.GetMulti(context, keys, deliveries)
+		if err == nil {
+			continue
+		}
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return nil, err
+		}
+		for i, e := range me {
+			if e == datastore.ErrNoSuchEntity {
+				undelivered = append(undelivered, tokens[off+i])
+			} else if e != nil {
+				return nil, e
+			}
+		}
+	}
+	return undelivered, nil
+}
+
+func RecordPushDeliveries(context appengine.Context, notification string, tokens []string) error {
+	now := time.Now()
+	for off := 0; off < len(tokens); off += multiLimit {
+		max := off + multiLimit
+		if max > len(tokens) {
+			max = len(tokens)
+		}
+
+		keys := make([]*datastore.Key, max-off)
+		deliveries := make([]PushDelivery, max-off)
+		for i, token := range tokens[off:max] {
+			keys[i] = pushDeliveryKey(context, notification, token)
+			deliveries[i] = PushDelivery{Notification: notification, Delivered: now}
+		}
+		if _, err := datastore.PutMulti(context, keys, deliveries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete up to limit ledger entries from before before. returns how many went.
+func PrunePushDeliveries(context appengine.Context, before time.Time, limit int) (int, error) {
+	query := datastore.NewQuery(KIND_PUSH_DELIVERY).Filter("Delivered <", before).KeysOnly().Limit(limit)
+	keys, err := query.GetAll(context, nil)
+	if err != nil {
+		return 0, err
+	}
+	for off := 0; off < len(keys); off += multiLimit {
+		max := off + multiLimit
+		if max > len(keys) {
+			max = len(keys)
+		}
+		if err := datastore.DeleteMulti(context, keys[off:max]); err != nil {
+			return off, err
+		}
+	}
+	return len(keys), nil
+}
+
 func newVideoKey(context appengine.Context, video *giantbomb.Video) *datastore.Key {
 	return datastore.NewKey(context, KIND_GIANT_BOMB_VIDEO, "", video.Id, nil)
 }
@@ -77,66 +798,764 @@ func PutVideo(context appengine.Context, video *giantbomb.Video) error {
 	return err
 }
 
-// put new videos into the datastore, ignore the old ones. returns all the new videos.
-func PutNewVideos(context appengine.Context, videos []giantbomb.Video) ([]*giantbomb.Video, error) {
-	keys := []*datastore.Key{}
-	for _, video := range videos {
-		keys = append(keys, newVideoKey(context, &video))
+// a field of a stored video that changed upstream
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old" datastore:",noindex"`
+	New   string `json:"new" datastore:",noindex"`
+}
+
+// the changes to a video found by one sync. stored as a child of the video.
+type VideoRevision struct {
+	VideoId int64         `json:"video_id"`
+	Changed time.Time     `json:"changed"`
+	Changes []FieldChange `json:"changes"`
+}
+
+func videoChanges(stored, fetched *giantbomb.Video) []FieldChange {
+	changes := []FieldChange{}
+	compare := func(field, old, new string) {
+		if old != new {
+			changes = append(changes, FieldChange{field, old, new})
+		}
 	}
 
-	newVideos := []*giantbomb.Video{} // we generally don't expect a lot of misses from the video pull
+	compare("name", stored.Name, fetched.Name)
+	compare("deck", stored.Deck, fetched.Deck)
+	compare("image", stored.Image.SuperUrl, fetched.Image.SuperUrl)
+	compare("video_type", stored.VideoType, fetched.VideoType)
+	compare("length_seconds", strconv.FormatInt(stored.LengthSeconds, 10), strconv.FormatInt(fetched.LengthSeconds, 10))
+	compare("publish_date", stored.PublishDate, fetched.PublishDate)
+	compare("site_detail_url", stored.SiteDetailUrl, fetched.SiteDetailUrl)
+	// a removed video that shows up again comes back
+	compare("removed", strconv.FormatBool(stored.Removed), strconv.FormatBool(fetched.Removed))
+
+	return changes
+}
 
-	if err := datastore.GetMulti(context, keys, make([]giantbomb.Video, len(keys))); err != nil {
-		// we've got misses
-		switch et := err.(type) {
-		case (appengine.MultiError):
-			for i, e := range et {
-				if e == datastore.ErrNoSuchEntity {
-					video := videos[i]
-					if pe := PutVideo(context, &video); pe != nil {
-						context.Errorf("PutVideo error %v", pe)
-					} else {
-						newVideos = append(newVideos, &video)
-					}
+func sameTerms(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// store video only if nothing is stored under key yet, so of two overlapping syncs only one sees it as new.
+func putNewVideo(context appengine.Context, key *datastore.Key, video *giantbomb.Video) (bool, error) {
+	isNew := false
+	err := datastore.RunInTransaction(context, func(context appengine.Context) error {
+		var stored giantbomb.Video
+		if err := datastore.Get(context, key, &stored); err == nil {
+			isNew = false
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		isNew = true
+		_, err := datastore.Put(context, key, video)
+		return err
+	}, nil)
+	return isNew, err
+}
+
+// put fetched videos into the datastore. new videos are stored, videos that changed upstream are updated and get a
+// revision recording what changed, and the rest are left alone. returns the new videos and the revisions.
+func SyncVideos(context appengine.Context, videos []giantbomb.Video) ([]*giantbomb.Video, []*VideoRevision, error) {
+	keys := make([]*datastore.Key, len(videos))
+	for i := range videos {
+		keys[i] = newVideoKey(context, &videos[i])
+	}
+
+	stored := make([]giantbomb.Video, len(keys))
+	errs := make(appengine.MultiError, len(keys))
+	if err := datastore.GetMulti(context, keys, stored); err != nil {
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return nil, nil, err
+		}
+		errs = me
+	}
+
+	newVideos := []*giantbomb.Video{}
+	revisions := []*VideoRevision{}
+
+	putKeys := []*datastore.Key{}
+	putVideos := []*giantbomb.Video{}
+	revisionKeys := []*datastore.Key{}
+
+	now := time.Now()
+	for i := range videos {
+		video := &videos[i]
+		video.SearchTerms = search.Terms(video.Name, video.Deck)
+
+		switch errs[i] {
+		case datastore.ErrNoSuchEntity:
+			video.Retrieved = now
+			isNew, err := putNewVideo(context, keys[i], video)
+			if err != nil {
+				context.Errorf("Put error for new video %v: %v", video.Id, err)
+			} else if isNew {
+				newVideos = append(newVideos, video)
+			}
+			// either stored now or by an overlapping sync. any change will be picked up next time.
+			continue
+		case nil:
+			changes := videoChanges(&stored[i], video)
+			if len(changes) == 0 {
+				if !sameTerms(stored[i].SearchTerms, video.SearchTerms) {
+					// stored before search or with an older tokenizer. reindex without a revision.
+					break
 				}
+				continue
 			}
+			revisions = append(revisions, &VideoRevision{VideoId: video.Id, Changed: now, Changes: changes})
+			revisionKeys = append(revisionKeys, datastore.NewIncompleteKey(context, KIND_GIANT_BOMB_VIDEO_REVISION, keys[i]))
 		default:
-			return nil, err
+			context.Errorf("Get error for video %v: %v", video.Id, errs[i])
+			continue
+		}
+
+		video.Retrieved = now
+		putKeys = append(putKeys, keys[i])
+		putVideos = append(putVideos, video)
+	}
+
+	if len(putKeys) > 0 {
+		if _, err := datastore.PutMulti(context, putKeys, putVideos); err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return newVideos, nil
+	if len(revisionKeys) > 0 {
+		if _, err := datastore.PutMulti(context, revisionKeys, revisions); err != nil {
+			// the videos are already updated, so this history is gone. not worth failing the sync over.
+			context.Errorf("PutMulti revisions error: %v", err)
+		}
+	}
+
+	return newVideos, revisions, nil
 }
 
-func PutChat(context appengine.Context, title string) (*giantbomb.Chat, error) {
-	key := datastore.NewKey(context, KIND_GIANT_BOMB_CHAT, title, 0, nil)
+// the newest stored videos that haven't been removed.
+func NewestVideos(context appengine.Context, limit int) ([]giantbomb.Video, error) {
+	var stored []giantbomb.Video
+	if _, err := datastore.NewQuery(KIND_GIANT_BOMB_VIDEO).Order("-Id").Limit(limit).GetAll(context, &stored); err != nil {
+		return nil, err
+	}
 
-	var chat giantbomb.Chat
+	videos := []giantbomb.Video{}
+	for _, video := range stored {
+		if !video.Removed {
+			videos = append(videos, video)
+		}
+	}
+	return videos, nil
+}
 
-	if err := datastore.Get(context, key, &chat); err != nil {
-		switch err {
-		case (datastore.ErrNoSuchEntity):
-			chat.Title = title
-			chat.FirstSeen = time.Now()
-			if _, pe := datastore.Put(context, key, &chat); pe != nil {
-				context.Errorf("Put error: %v", pe)
-			} else {
-				return &chat, nil
+// stored videos published since the given time that haven't been removed, newest first.
+func RecentVideos(context appengine.Context, since time.Time, limit int) ([]giantbomb.Video, error) {
+	query := datastore.NewQuery(KIND_GIANT_BOMB_VIDEO).
+		Filter("PublishDate >=", giantbomb.FormatDate(since)).
+		Order("-PublishDate").
+		Limit(limit)
+
+	var stored []giantbomb.Video
+	if _, err := query.GetAll(context, &stored); err != nil {
+		return nil, err
+	}
+
+	videos := []giantbomb.Video{}
+	for _, video := range stored {
+		if !video.Removed {
+			videos = append(videos, video)
+		}
+	}
+	return videos, nil
+}
+
+// mark videos as removed upstream and record a revision for each.
+func TombstoneVideos(context appengine.Context, videos []giantbomb.Video) error {
+	keys := make([]*datastore.Key, len(videos))
+	revisionKeys := make([]*datastore.Key, len(videos))
+	revisions := make([]*VideoRevision, len(videos))
+
+	now := time.Now()
+	for i := range videos {
+		videos[i].Removed = true
+		videos[i].RemovedAt = now
+		keys[i] = newVideoKey(context, &videos[i])
+		revisionKeys[i] = datastore.NewIncompleteKey(context, KIND_GIANT_BOMB_VIDEO_REVISION, keys[i])
+		revisions[i] = &VideoRevision{
+			VideoId: videos[i].Id,
+			Changed: now,
+			Changes: []FieldChange{{"removed", "false", "true"}},
+		}
+	}
+
+	if _, err := datastore.PutMulti(context, keys, videos); err != nil {
+		return err
+	}
+	if _, err := datastore.PutMulti(context, revisionKeys, revisions); err != nil {
+		context.Errorf("PutMulti revisions error: %v", err)
+	}
+	return nil
+}
+
+// videos matching a search, newest first. each group in terms is a set of alternatives and a video has to match one
+// term from every group. returns a page of videos and the total number of matches, neither counting removed videos.
+//
+// the rarest group is found with keys only queries and its videos are loaded and checked against the other groups,
+// so a common term can't push matches of a rare one out of the window. only when every group has more than
+// config.SearchMaxMatches matches are results limited to the newest of the rarest.
+func SearchVideos(context appengine.Context, terms [][]string, offset, limit int) ([]giantbomb.Video, int, error) {
+	var rarest []int64
+	for i, group := range terms {
+		ids, err := searchGroupIds(context, group)
+		if err != nil {
+			return nil, 0, err
+		}
+		if i == 0 || len(ids) < len(rarest) {
+			rarest = ids
+		}
+	}
+
+	// ids go up over time, so this is newest first
+	sort.Sort(sort.Reverse(int64Slice(rarest)))
+
+	matches := []giantbomb.Video{}
+	for off := 0; off < len(rarest); off += multiLimit {
+		max := off + multiLimit
+		if max > len(rarest) {
+			max = len(rarest)
+		}
+
+		keys := make([]*datastore.Key, max-off)
+		for i, id := range rarest[off:max] {
+			keys[i] = datastore.NewKey(context, KIND_GIANT_BOMB_VIDEO, "", id, nil)
+		}
+		stored := make([]giantbomb.Video, len(keys))
+		err := datastore.GetMulti(context, keys, stored)
+		me, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			return nil, 0, err
+		}
+
+		for i := range stored {
+			if ok && me[i] == datastore.ErrNoSuchEntity {
+				continue
+			} else if ok && me[i] != nil {
+				return nil, 0, me[i]
 			}
-		default:
+			if !stored[i].Removed && matchesTerms(stored[i].SearchTerms, terms) {
+				matches = append(matches, stored[i])
+			}
+		}
+	}
+
+	if offset >= len(matches) {
+		return []giantbomb.Video{}, len(matches), nil
+	}
+	videos := matches[offset:]
+	if len(videos) > limit {
+		videos = videos[:limit]
+	}
+	return videos, len(matches), nil
+}
+
+// ids of the videos matching any term of group, up to config.SearchMaxMatches of the newest for each term
+func searchGroupIds(context appengine.Context, group []string) ([]int64, error) {
+	seen := map[int64]bool{}
+	ids := []int64{}
+	for _, term := range group {
+		query := datastore.NewQuery(KIND_GIANT_BOMB_VIDEO).
+			Filter("SearchTerms =", term).
+			Order("-Id").
+			KeysOnly().
+			Limit(config.SearchMaxMatches)
+		keys, err := query.GetAll(context, nil)
+		if err != nil {
 			return nil, err
 		}
-	} else {
-		if time.Now().After(chat.FirstSeen.Add(time.Hour * 24)) {
-			chat.FirstSeen = time.Now()
-			if _, pe := datastore.Put(context, key, &chat); pe != nil {
-				context.Errorf("Put error on update: %v", pe)
-			} else {
-				context.Infof("Updating existing entry for %v since it is over 24 hours old", title)
-				return &chat, nil
+		for _, key := range keys {
+			if !seen[key.IntID()] {
+				seen[key.IntID()] = true
+				ids = append(ids, key.IntID())
+			}
+		}
+	}
+	return ids, nil
+}
+
+// whether a video with searchTerms has a term from every group
+func matchesTerms(searchTerms []string, terms [][]string) bool {
+	have := map[string]bool{}
+	for _, term := range searchTerms {
+		have[term] = true
+	}
+
+	for _, group := range terms {
+		found := false
+		for _, term := range group {
+			if have[term] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// revisions for one video, newest first.
+func VideoRevisions(context appengine.Context, videoId int64) ([]VideoRevision, error) {
+	ancestor := datastore.NewKey(context, KIND_GIANT_BOMB_VIDEO, "", videoId, nil)
+	revisions := []VideoRevision{}
+	query := datastore.NewQuery(KIND_GIANT_BOMB_VIDEO_REVISION).Ancestor(ancestor).Order("-Changed")
+	if _, err := query.GetAll(context, &revisions); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// revisions across all videos, newest first. returns a cursor for the next page, empty once there's nothing left.
+func RecentVideoRevisions(context appengine.Context, cursor string, limit int) ([]VideoRevision, string, error) {
+	query := datastore.NewQuery(KIND_GIANT_BOMB_VIDEO_REVISION).Order("-Changed")
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(c)
+	}
+
+	revisions := []VideoRevision{}
+	iterator := query.Run(context)
+	for len(revisions) < limit {
+		var revision VideoRevision
+		_, err := iterator.Next(&revision)
+		if err == datastore.Done {
+			return revisions, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		revisions = append(revisions, revision)
+	}
+
+	next, err := iterator.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return revisions, next.String(), nil
+}
+
+// id of the newest video in the store, 0 if it's empty.
+func NewestVideoId(context appengine.Context) (int64, error) {
+	keys, err := datastore.NewQuery(KIND_GIANT_BOMB_VIDEO).Order("-Id").KeysOnly().Limit(1).GetAll(context, nil)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	return keys[0].IntID(), nil
+}
+
+// where the regular video pull left off
+type VideoSyncState struct {
+	HighWaterMark int64 // newest video id seen by a pull
+	Updated       time.Time
+
+	// the last time the pull ran out of pages before reaching the mark, and the ids it may have missed between.
+	GapFound    time.Time
+	GapAfterId  int64
+	GapBeforeId int64
+}
+
+func videoSyncStateKey(context appengine.Context) *datastore.Key {
+	return datastore.NewKey(context, KIND_SYNC_STATE, "videos", 0, nil)
+}
+
+// returns a zero state if the pull has never recorded one.
+func GetVideoSyncState(context appengine.Context) (*VideoSyncState, error) {
+	var state VideoSyncState
+	if err := datastore.Get(context, videoSyncStateKey(context), &state); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func PutVideoSyncState(context appengine.Context, state *VideoSyncState) error {
+	state.Updated = time.Now()
+	_, err := datastore.Put(context, videoSyncStateKey(context), state)
+	return err
+}
+
+// filters for QueryVideos. zero values are ignored.
+type VideoQuery struct {
+	VideoType       string
+	PublishedAfter  time.Time // inclusive
+	PublishedBefore time.Time // exclusive
+	MinLength       int64     // seconds
+	MaxLength       int64     // seconds
+	Cursor          string
+	Limit           int
+}
+
+// page through stored videos, newest first. returns the videos and a cursor for the next page, which is empty once
+// there's nothing left.
+func QueryVideos(context appengine.Context, q *VideoQuery) ([]giantbomb.Video, string, error) {
+	query := datastore.NewQuery(KIND_GIANT_BOMB_VIDEO).Order("-PublishDate")
+	if q.VideoType != "" {
+		query = query.Filter("VideoType =", q.VideoType)
+	}
+	// publish dates are stored in giantbomb's format, which sorts as a string.
+	if !q.PublishedAfter.IsZero() {
+		query = query.Filter("PublishDate >=", giantbomb.FormatDate(q.PublishedAfter))
+	}
+	if !q.PublishedBefore.IsZero() {
+		query = query.Filter("PublishDate <", giantbomb.FormatDate(q.PublishedBefore))
+	}
+	if q.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(cursor)
+	}
+
+	// the datastore only allows an inequality filter on one property, so length is filtered here, along with removed
+	// videos since older entities don't have the property at all. don't let a filter that matches nothing walk the
+	// entire store in one request.
+	videos := []giantbomb.Video{}
+	iterator := query.Run(context)
+	for scanned := 0; len(videos) < q.Limit && scanned < config.VideoQueryMaxScan; scanned++ {
+		var video giantbomb.Video
+		_, err := iterator.Next(&video)
+		if err == datastore.Done {
+			return videos, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		if video.Removed {
+			continue
+		}
+		if q.MinLength > 0 && video.LengthSeconds < q.MinLength {
+			continue
+		}
+		if q.MaxLength > 0 && video.LengthSeconds > q.MaxLength {
+			continue
+		}
+		videos = append(videos, video)
+	}
+
+	cursor, err := iterator.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+
+	return videos, cursor.String(), nil
+}
+
+// progress of a walk over the whole giantbomb video archive
+type BackfillState struct {
+	Running   bool      `json:"running"`
+	Run       int       `json:"run"`    // bumped on every start so stale tasks can tell
+	Offset    int       `json:"offset"` // next offset to fetch
+	Total     int64     `json:"total"`  // number_of_total_results as of the last page
+	Stored    int       `json:"stored"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
+	Finished  time.Time `json:"finished"`
+	LastError string    `json:"last_error"`
+}
+
+func backfillStateKey(context appengine.Context) *datastore.Key {
+	return datastore.NewKey(context, KIND_BACKFILL_STATE, "videos", 0, nil)
+}
+
+// returns a zero state if the backfill has never run.
+func GetBackfillState(context appengine.Context) (*BackfillState, error) {
+	var state BackfillState
+	if err := datastore.Get(context, backfillStateKey(context), &state); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// apply update to the stored backfill state in a transaction. nothing is written if update returns an error.
+func UpdateBackfillState(context appengine.Context, update func(*BackfillState) error) (*BackfillState, error) {
+	var state *BackfillState
+	err := datastore.RunInTransaction(context, func(context appengine.Context) error {
+		var err error
+		if state, err = GetBackfillState(context); err != nil {
+			return err
+		}
+		if err := update(state); err != nil {
+			return err
+		}
+		state.Updated = time.Now()
+		_, err = datastore.Put(context, backfillStateKey(context), state)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// a giantbomb video type. Name is giantbomb's and is what videos and subscriptions refer to, DisplayName and Hidden
+// are admin overrides that survive syncs.
+type VideoCategory struct {
+	Id          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Deck        string    `json:"deck" datastore:",noindex"`
+	DisplayName string    `json:"display_name"`
+	Hidden      bool      `json:"hidden"`
+	LastSynced  time.Time `json:"last_synced"`
+}
+
+func videoCategoryKey(context appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(context, KIND_VIDEO_CATEGORY, "", id, nil)
+}
+
+func VideoCategories(context appengine.Context) ([]VideoCategory, error) {
+	categories := []VideoCategory{}
+	if _, err := datastore.NewQuery(KIND_VIDEO_CATEGORY).Order("Id").GetAll(context, &categories); err != nil {
+		return nil, err
+	}
+	return categories, nil
+}
+
+// store video types fetched from giantbomb, keeping any overrides.
+func SyncVideoCategories(context appengine.Context, videoTypes []giantbomb.VideoType) error {
+	keys := make([]*datastore.Key, len(videoTypes))
+	for i := range videoTypes {
+		keys[i] = videoCategoryKey(context, videoTypes[i].Id)
+	}
+
+	categories := make([]VideoCategory, len(keys))
+	if err := datastore.GetMulti(context, keys, categories); err != nil {
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			return err
+		}
+		for _, e := range me {
+			if e != nil && e != datastore.ErrNoSuchEntity {
+				return e
 			}
 		}
 	}
 
-	return nil, errors.New("Chat is already recorded")
+	now := time.Now()
+	for i, videoType := range videoTypes {
+		categories[i].Id = videoType.Id
+		categories[i].Name = videoType.Name
+		categories[i].Deck = videoType.Deck
+		categories[i].LastSynced = now
+	}
+
+	_, err := datastore.PutMulti(context, keys, categories)
+	return err
+}
+
+// apply admin overrides to a stored category.
+func UpdateVideoCategory(context appengine.Context, id int64, update func(*VideoCategory)) (*VideoCategory, error) {
+	var category VideoCategory
+	err := datastore.RunInTransaction(context, func(context appengine.Context) error {
+		key := videoCategoryKey(context, id)
+		if err := datastore.Get(context, key, &category); err != nil {
+			return err
+		}
+		update(&category)
+		_, err := datastore.Put(context, key, &category)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &category, nil
+}
+
+// a server side feature flag. a flag is on for a client if it's Enabled, the client is on one of Platforms (any if
+// empty), its version is within MinVersion and MaxVersion (either may be empty), and its device falls in the first
+// RolloutPercent of buckets.
+type FeatureFlag struct {
+	Name           string    `json:"name"`
+	Description    string    `json:"description" datastore:",noindex"`
+	Enabled        bool      `json:"enabled"`
+	RolloutPercent int       `json:"rollout_percent"`
+	Platforms      []string  `json:"platforms"`
+	MinVersion     string    `json:"min_version"`
+	MaxVersion     string    `json:"max_version"`
+	Updated        time.Time `json:"updated"`
+}
+
+func featureFlagKey(context appengine.Context, name string) *datastore.Key {
+	return datastore.NewKey(context, KIND_FEATURE_FLAG, name, 0, nil)
+}
+
+func FeatureFlags(context appengine.Context) ([]FeatureFlag, error) {
+	flags := []FeatureFlag{}
+	if _, err := datastore.NewQuery(KIND_FEATURE_FLAG).GetAll(context, &flags); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+func PutFeatureFlag(context appengine.Context, flag *FeatureFlag) error {
+	flag.Updated = time.Now()
+	_, err := datastore.Put(context, featureFlagKey(context, flag.Name), flag)
+	return err
+}
+
+func DeleteFeatureFlag(context appengine.Context, name string) error {
+	return datastore.Delete(context, featureFlagKey(context, name))
+}
+
+// where a suggestion came from
+const SUGGESTION_SOURCE_GAME = "game"
+const SUGGESTION_SOURCE_SEARCH = "search"
+
+// text worth suggesting that isn't a stored video name
+type SuggestionSource struct {
+	Text     string `datastore:",noindex"`
+	Source   string
+	Count    int64 // times seen, only counted for searches
+	LastSeen time.Time
+}
+
+func suggestionSourceKey(context appengine.Context, source, text string) *datastore.Key {
+	return datastore.NewKey(context, KIND_SUGGESTION_SOURCE, source+"/"+search.Normalize(text), 0, nil)
+}
+
+// add count searches for query towards the popular searches.
+func RecordSearch(context appengine.Context, query string, count int64) error {
+	key := suggestionSourceKey(context, SUGGESTION_SOURCE_SEARCH, query)
+	return datastore.RunInTransaction(context, func(context appengine.Context) error {
+		var recorded SuggestionSource
+		if err := datastore.Get(context, key, &recorded); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		recorded.Text = query
+		recorded.Source = SUGGESTION_SOURCE_SEARCH
+		recorded.Count += count
+		recorded.LastSeen = time.Now()
+		_, err := datastore.Put(context, key, &recorded)
+		return err
+	}, nil)
+}
+
+// remember game names. names we already have are left alone.
+func RecordGameNames(context appengine.Context, names []string) error {
+	keys := make([]*datastore.Key, len(names))
+	for i, name := range names {
+		keys[i] = suggestionSourceKey(context, SUGGESTION_SOURCE_GAME, name)
+	}
+
+	err := datastore.GetMulti(context, keys, make([]SuggestionSource, len(keys)))
+	if err == nil {
+		return nil
+	}
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	newKeys := []*datastore.Key{}
+	newSources := []*SuggestionSource{}
+	for i, e := range me {
+		if e == datastore.ErrNoSuchEntity {
+			newKeys = append(newKeys, keys[i])
+			newSources = append(newSources, &SuggestionSource{Text: names[i], Source: SUGGESTION_SOURCE_GAME, LastSeen: time.Now()})
+		}
+	}
+
+	_, err = datastore.PutMulti(context, newKeys, newSources)
+	return err
+}
+
+// suggestion sources from one source, most seen first.
+func SuggestionSources(context appengine.Context, source string, limit int) ([]SuggestionSource, error) {
+	sources := []SuggestionSource{}
+	query := datastore.NewQuery(KIND_SUGGESTION_SOURCE).Filter("Source =", source).Order("-Count").Limit(limit)
+	if _, err := query.GetAll(context, &sources); err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// the suggestions every instance loads, built periodically from the stored sources.
+type SuggestionSnapshot struct {
+	Data  []byte // json encoded []search.Suggestion
+	Built time.Time
+}
+
+func suggestionSnapshotKey(context appengine.Context) *datastore.Key {
+	return datastore.NewKey(context, KIND_SUGGESTION_SNAPSHOT, "current", 0, nil)
+}
+
+func PutSuggestionSnapshot(context appengine.Context, suggestions []search.Suggestion) error {
+	data, err := json.Marshal(suggestions)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(context, suggestionSnapshotKey(context), &SuggestionSnapshot{data, time.Now()})
+	return err
+}
+
+// returns no suggestions if a snapshot hasn't been built yet.
+func GetSuggestionSnapshot(context appengine.Context) ([]search.Suggestion, error) {
+	var snapshot SuggestionSnapshot
+	if err := datastore.Get(context, suggestionSnapshotKey(context), &snapshot); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return []search.Suggestion{}, nil
+		}
+		return nil, err
+	}
+
+	suggestions := []search.Suggestion{}
+	if err := json.Unmarshal(snapshot.Data, &suggestions); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
+
+// record a chat as new unless it was already seen in the last 24 hours. the check and the put are one transaction,
+// so overlapping polls can't both see it as new.
+func PutChat(context appengine.Context, title string) (*giantbomb.Chat, error) {
+	key := datastore.NewKey(context, KIND_GIANT_BOMB_CHAT, title, 0, nil)
+
+	var chat giantbomb.Chat
+	err := datastore.RunInTransaction(context, func(context appengine.Context) error {
+		if err := datastore.Get(context, key, &chat); err == nil {
+			if time.Now().Before(chat.FirstSeen.Add(time.Hour * 24)) {
+				return ErrChatRecorded
+			}
+			context.Infof("Updating existing entry for %v since it is over 24 hours old", title)
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		chat.Title = title
+		chat.FirstSeen = time.Now()
+		_, err := datastore.Put(context, key, &chat)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &chat, nil
 }
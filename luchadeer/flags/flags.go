@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package flags
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"hash/fnv"
+	"luchadeer/client"
+	"luchadeer/config"
+	"luchadeer/db"
+)
+
+// flags the backend itself checks
+const ProxyRequests = "proxy_requests"
+const SearchProxy = "search_proxy"
+const PushNotifications = "push_notifications"
+
+// client facing flags, defaults are in config.Features
+const LocalVideos = "local_videos"
+const LocalSearch = "local_search"
+const SearchSuggest = "search_suggest"
+const SlimResponses = "slim_responses"
+
+const cacheKey = "flags/all"
+
+// value of every known flag when nothing is stored for it
+func Defaults() map[string]bool {
+	defaults := map[string]bool{
+		ProxyRequests:     config.ProxyRequests,
+		SearchProxy:       config.SearchProxyEnabled,
+		PushNotifications: true,
+	}
+	for name, on := range config.Features {
+		defaults[name] = on
+	}
+	return defaults
+}
+
+// who a flag is being checked for. leave out whatever isn't known, a flag that targets it is then off.
+type Target struct {
+	Device   string
+	Platform string
+	Version  client.Version
+}
+
+func TargetFor(info *client.Info) *Target {
+	return &Target{Device: info.Device, Platform: info.Platform, Version: info.Version}
+}
+
+// a snapshot of the stored flags
+type Set struct {
+	flags map[string]*db.FeatureFlag
+}
+
+func Load(context appengine.Context) (*Set, error) {
+	var flags []db.FeatureFlag
+	if _, err := memcache.Gob.Get(context, cacheKey, &flags); err != nil {
+		if err != memcache.ErrCacheMiss {
+			context.Errorf("memcache error: %v", err)
+		}
+		if flags, err = db.FeatureFlags(context); err != nil {
+			return nil, err
+		}
+		memcache.Gob.Set(context, &memcache.Item{
+			Key:        cacheKey,
+			Object:     flags,
+			Expiration: config.FlagCacheTTL,
+		})
+	}
+
+	set := &Set{map[string]*db.FeatureFlag{}}
+	for i := range flags {
+		set.flags[flags[i].Name] = &flags[i]
+	}
+	return set, nil
+}
+
+// drop the cached flags after a stored one changes.
+func Invalidate(context appengine.Context) {
+	if err := memcache.Delete(context, cacheKey); err != nil && err != memcache.ErrCacheMiss {
+		context.Errorf("memcache error: %v", err)
+	}
+}
+
+// whether name is on for target. flags that aren't stored use their default, unknown flags are off.
+func (s *Set) Enabled(name string, target *Target) bool {
+	flag, ok := s.flags[name]
+	if !ok {
+		return Defaults()[name]
+	}
+	return Evaluate(flag, target)
+}
+
+// every known flag, stored or not, evaluated for target.
+func (s *Set) All(target *Target) map[string]bool {
+	all := map[string]bool{}
+	for name := range Defaults() {
+		all[name] = s.Enabled(name, target)
+	}
+	for name := range s.flags {
+		all[name] = s.Enabled(name, target)
+	}
+	return all
+}
+
+// Load and Set.Enabled in one. falls back to the default if the flags can't be loaded.
+func Enabled(context appengine.Context, name string, target *Target) bool {
+	set, err := Load(context)
+	if err != nil {
+		context.Errorf("flags.Load: %v", err)
+		return Defaults()[name]
+	}
+	return set.Enabled(name, target)
+}
+
+func Evaluate(flag *db.FeatureFlag, target *Target) bool {
+	if !flag.Enabled {
+		return false
+	}
+
+	if len(flag.Platforms) > 0 {
+		found := false
+		for _, platform := range flag.Platforms {
+			found = found || platform == target.Platform
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if flag.MinVersion != "" || flag.MaxVersion != "" {
+		if target.Version == nil {
+			return false
+		}
+		if min, err := client.ParseVersion(flag.MinVersion); err == nil && target.Version.Less(min) {
+			return false
+		}
+		if max, err := client.ParseVersion(flag.MaxVersion); err == nil && max.Less(target.Version) {
+			return false
+		}
+	}
+
+	if flag.RolloutPercent >= 100 {
+		return true
+	}
+	if target.Device == "" {
+		return false
+	}
+	return Bucket(flag.Name, target.Device) < flag.RolloutPercent
+}
+
+// a device's bucket for a flag, 0-99. stable for the pair, and independent between flags.
+func Bucket(name, device string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + device))
+	return int(h.Sum32() % 100)
+}
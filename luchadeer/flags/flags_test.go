@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package flags
+
+import (
+	"fmt"
+	"luchadeer/client"
+	"luchadeer/db"
+	"testing"
+)
+
+func TestBucket(t *testing.T) {
+	counts := make([]int, 100)
+	differs := 0
+	for i := 0; i < 10000; i++ {
+		device := fmt.Sprintf("device-%d", i)
+		bucket := Bucket("new_player", device)
+		if bucket < 0 || bucket > 99 {
+			t.Fatalf("Bucket(new_player, %v) = %v, out of range", device, bucket)
+		}
+		if Bucket("new_player", device) != bucket {
+			t.Fatalf("Bucket(new_player, %v) isn't stable", device)
+		}
+		if Bucket("dark_mode", device) != bucket {
+			differs++
+		}
+		counts[bucket]++
+	}
+
+	// roughly uniform, and not the same split for every flag
+	for bucket, count := range counts {
+		if count < 50 || count > 150 {
+			t.Errorf("bucket %v got %v of 10000 devices", bucket, count)
+		}
+	}
+	if differs < 9000 {
+		t.Errorf("only %v of 10000 devices changed bucket between flags", differs)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	// a device inside and one outside a 50% rollout of "rollout"
+	var in, out string
+	for i := 0; in == "" || out == ""; i++ {
+		device := fmt.Sprintf("device-%d", i)
+		if Bucket("rollout", device) < 50 {
+			in = device
+		} else {
+			out = device
+		}
+	}
+
+	android := client.PlatformAndroid
+	ios := client.PlatformIOS
+	v120 := client.Version{1, 2, 0}
+
+	tests := []struct {
+		name   string
+		flag   db.FeatureFlag
+		target Target
+		want   bool
+	}{
+		{"off", db.FeatureFlag{Name: "rollout", RolloutPercent: 100}, Target{in, android, v120}, false},
+		{"on", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100}, Target{}, true},
+		{"platform match", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, Platforms: []string{ios, android}}, Target{in, android, v120}, true},
+		{"platform mismatch", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, Platforms: []string{ios}}, Target{in, android, v120}, false},
+		{"platform unknown", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, Platforms: []string{ios}}, Target{in, "", v120}, false},
+		{"at min version", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, MinVersion: "1.2"}, Target{in, android, v120}, true},
+		{"below min version", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, MinVersion: "1.2.1"}, Target{in, android, v120}, false},
+		{"at max version", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, MaxVersion: "1.2.0"}, Target{in, android, v120}, true},
+		{"above max version", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, MaxVersion: "1.1"}, Target{in, android, v120}, false},
+		{"version unknown", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, MinVersion: "1.0"}, Target{in, android, nil}, false},
+		{"bad version bound ignored", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 100, MinVersion: "one"}, Target{in, android, v120}, true},
+		{"rollout in", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 50}, Target{in, android, v120}, true},
+		{"rollout out", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 50}, Target{out, android, v120}, false},
+		{"rollout device unknown", db.FeatureFlag{Name: "rollout", Enabled: true, RolloutPercent: 50}, Target{"", android, v120}, false},
+		{"rollout zero", db.FeatureFlag{Name: "rollout", Enabled: true}, Target{in, android, v120}, false},
+	}
+
+	for _, test := range tests {
+		target := test.target
+		if got := Evaluate(&test.flag, &target); got != test.want {
+			t.Errorf("%v: Evaluate = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -32,20 +32,170 @@ package gcm
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-type GCMMessage struct {
-	Data            map[string]interface{} `json:"data"`
-	RegistrationIds []string               `json:"registration_ids"`
+// FCM HTTP v1. both urls can be pointed somewhere else for testing.
+var SendURL = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+var TokenURL = "https://oauth2.googleapis.com/token"
+var MethodPost = "POST"
+
+const Scope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// requests in flight at once per Send. v1 has no multicast, every token is a request.
+const DefaultConcurrency = 20
+
+// the parts of a google service account key file we use
+type ServiceAccount struct {
+	ProjectId   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func ParseServiceAccount(data []byte) (*ServiceAccount, error) {
+	var account ServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, err
+	}
+	if account.ProjectId == "" || account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("Incomplete service account")
+	}
+	return &account, nil
+}
+
+// delivery options, named after their legacy api fields. zero values are left out.
+type Options struct {
+	CollapseKey           string        // messages with the same key replace each other while waiting for delivery
+	TimeToLive            time.Duration // fcm drops the message if it can't deliver it in this long
+	Priority              string        // PriorityHigh or PriorityNormal
+	DelayWhileIdle        bool          // v1 dropped this, fcm now decides on its own. kept so callers don't care.
+	RestrictedPackageName string        // only deliver to this app package
+	DryRun                bool          // validate the message without delivering it
+}
+
+const PriorityHigh = "high"
+const PriorityNormal = "normal"
+
+// v1 spells priorities as AndroidMessagePriority enum names. anything else is left to fcm's default.
+var v1Priorities = map[string]string{
+	PriorityHigh:   "HIGH",
+	PriorityNormal: "NORMAL",
+}
+
+// v1 messages. data values have to be strings.
+type Message struct {
+	Token   string            `json:"token"`
+	Data    map[string]string `json:"data,omitempty"`
+	Android *AndroidConfig    `json:"android,omitempty"`
+}
+
+type AndroidConfig struct {
+	CollapseKey           string `json:"collapse_key,omitempty"`
+	Priority              string `json:"priority,omitempty"`
+	TTL                   string `json:"ttl,omitempty"`
+	RestrictedPackageName string `json:"restricted_package_name,omitempty"`
+}
+
+type sendRequest struct {
+	ValidateOnly bool     `json:"validate_only,omitempty"`
+	Message      *Message `json:"message"`
+}
+
+func androidConfig(options *Options) *AndroidConfig {
+	if options == nil {
+		return nil
+	}
+	config := &AndroidConfig{
+		CollapseKey:           options.CollapseKey,
+		Priority:              v1Priorities[options.Priority],
+		RestrictedPackageName: options.RestrictedPackageName,
+	}
+	if options.TimeToLive > 0 {
+		config.TTL = fmt.Sprintf("%ds", int64(options.TimeToLive/time.Second))
+	}
+	if *config == (AndroidConfig{}) {
+		return nil
+	}
+	return config
+}
+
+type sendResponse struct {
+	Name string `json:"name"`
+}
+
+// v1 error body
+type Status struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			Type            string `json:"@type"`
+			ErrorCode       string `json:"errorCode"`
+			FieldViolations []struct {
+				Field       string `json:"field"`
+				Description string `json:"description"`
+			} `json:"fieldViolations"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// the FcmError code if there is one, otherwise the canonical status
+func (s *Status) Code() string {
+	for _, detail := range s.Error.Details {
+		if detail.ErrorCode != "" {
+			return detail.ErrorCode
+		}
+	}
+	return s.Error.Status
+}
+
+// whether the request was rejected for its token rather than something else in the message
+func (s *Status) BadToken() bool {
+	for _, detail := range s.Error.Details {
+		for _, violation := range detail.FieldViolations {
+			if violation.Field == "message.token" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// v1 error codes mapped onto the legacy error strings everything downstream understands. codes that aren't listed
+// pass through as they are.
+var legacyErrors = map[string]string{
+	"UNREGISTERED":       "NotRegistered",
+	"NOT_FOUND":          "NotRegistered",
+	"SENDER_ID_MISMATCH": "MismatchSenderId",
+	"UNAVAILABLE":        "Unavailable",
+	"INTERNAL":           "InternalServerError",
+	"QUOTA_EXCEEDED":     "QuotaExceeded",
 }
 
+// results are reported the way the legacy api did, one per registration id in order, so callers didn't have to
+// change with the move to v1. v1 never returns canonical ids.
 type GCMResult struct {
-	MessageId      string `json:"message_id"`
-	RegistrationId string `json:"registration_id"`
-	Error          string `json:"error"`
+	MessageId      string        `json:"message_id"`
+	RegistrationId string        `json:"registration_id"`
+	Error          string        `json:"error"`
+	RetryAfter     time.Duration `json:"-"` // how long fcm asked us to wait before trying again, if it did
 }
 
 type GCMResponse struct {
@@ -57,56 +207,254 @@ type GCMResponse struct {
 }
 
 type GCM struct {
-	apiKey string
-	client *http.Client
+	account     *ServiceAccount
+	key         *rsa.PrivateKey
+	client      *http.Client
+	Concurrency int
 }
 
-var GCMSendURL = "https://android.googleapis.com/gcm/send"
-var MethodPost = "POST"
+func NewGCM(account *ServiceAccount, client *http.Client) (*GCM, error) {
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("No PEM block in service account key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Service account key is not an RSA key")
+	}
 
-func NewGCM(apiKey string, client *http.Client) *GCM {
 	if client == nil {
 		client = http.DefaultClient
 	}
 
 	return &GCM{
-		apiKey: apiKey,
-		client: client,
+		account:     account,
+		key:         key,
+		client:      client,
+		Concurrency: DefaultConcurrency,
+	}, nil
+}
+
+// access tokens are cached per service account for the life of the instance, since a GCM only lives as long as the
+// request that made it.
+type accessToken struct {
+	token  string
+	expiry time.Time
+}
+
+var tokens = struct {
+	sync.Mutex
+	cache map[string]accessToken
+}{cache: map[string]accessToken{}}
+
+func (gcm *GCM) tokenURL() string {
+	if gcm.account.TokenURI != "" {
+		return gcm.account.TokenURI
 	}
+	return TokenURL
 }
 
-func (gcm *GCM) Send(data map[string]interface{}, registrationIds []string) (*GCMResponse, error) {
-	marshalled, err := json.Marshal(&GCMMessage{
-		Data:            data,
-		RegistrationIds: registrationIds,
+// a signed jwt asserting the service account, for the token exchange
+func (gcm *GCM) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   gcm.account.ClientEmail,
+		"scope": Scope,
+		"aud":   gcm.tokenURL(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
 	})
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signing))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, gcm.key, crypto.SHA256, digest[:])
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	return signing + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (gcm *GCM) accessToken() (string, error) {
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	if cached, ok := tokens.cache[gcm.account.ClientEmail]; ok && time.Now().Before(cached.expiry) {
+		return cached.token, nil
 	}
 
-	req, err := http.NewRequest(MethodPost, GCMSendURL, bytes.NewBuffer(marshalled))
+	now := time.Now()
+	assertion, err := gcm.assertion(now)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := gcm.client.PostForm(gcm.tokenURL(), url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Token exchange returned status: %v", resp.StatusCode)
+	}
+
+	var exchanged struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&exchanged); err != nil {
+		return "", err
+	}
+
+	// leave a minute of slack so a token doesn't expire mid send
+	tokens.cache[gcm.account.ClientEmail] = accessToken{
+		token:  exchanged.AccessToken,
+		expiry: now.Add(time.Duration(exchanged.ExpiresIn)*time.Second - time.Minute),
+	}
+	return exchanged.AccessToken, nil
+}
+
+// send data to every registration id. options may be nil. an error means nothing was sent, per token failures are
+// in the results.
+func (gcm *GCM) Send(data map[string]interface{}, registrationIds []string, options *Options) (*GCMResponse, error) {
+	token, err := gcm.accessToken()
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Authorization", "key="+gcm.apiKey)
+	stringData := map[string]string{}
+	for k, v := range data {
+		stringData[k] = fmt.Sprint(v)
+	}
+
+	android := androidConfig(options)
+	dryRun := options != nil && options.DryRun
+
+	response := &GCMResponse{Results: make([]GCMResult, len(registrationIds))}
+
+	concurrency := gcm.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+
+	for i, registrationId := range registrationIds {
+		wg.Add(1)
+		sem <- true
+		go func(i int, registrationId string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			response.Results[i] = gcm.sendOne(token, &sendRequest{
+				ValidateOnly: dryRun,
+				Message:      &Message{Token: registrationId, Data: stringData, Android: android},
+			})
+		}(i, registrationId)
+	}
+	wg.Wait()
+
+	for _, result := range response.Results {
+		if result.Error == "" {
+			response.Success++
+		} else {
+			response.Failure++
+		}
+	}
+
+	return response, nil
+}
+
+func (gcm *GCM) sendOne(token string, request *sendRequest) GCMResult {
+	marshalled, err := json.Marshal(request)
+	if err != nil {
+		return GCMResult{Error: err.Error()}
+	}
+
+	req, err := http.NewRequest(MethodPost, fmt.Sprintf(SendURL, gcm.account.ProjectId), bytes.NewBuffer(marshalled))
+	if err != nil {
+		return GCMResult{Error: err.Error()}
+	}
+
+	req.Header.Add("Authorization", "Bearer "+token)
 	req.Header.Add("Content-Type", "application/json")
 
 	resp, err := gcm.client.Do(req)
 	if err != nil {
-		return nil, err
+		return GCMResult{Error: "Unavailable"}
 	}
 	defer resp.Body.Close()
 
+	decoder := json.NewDecoder(resp.Body)
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Non OK return status: %v", resp.StatusCode)
+		result := GCMResult{RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+
+		var status Status
+		if err := decoder.Decode(&status); err != nil || status.Code() == "" {
+			result.Error = statusError(resp.StatusCode)
+		} else if status.Code() == "INVALID_ARGUMENT" && status.BadToken() {
+			// a garbage token, as dead as an unregistered one
+			result.Error = "InvalidRegistration"
+		} else if legacy, ok := legacyErrors[status.Code()]; ok {
+			result.Error = legacy
+		} else {
+			result.Error = camelCase(status.Code())
+		}
+		return result
 	}
 
-	var gcmResponse GCMResponse
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&gcmResponse); err != nil {
-		return nil, err
+	var sent sendResponse
+	if err := decoder.Decode(&sent); err != nil {
+		return GCMResult{Error: err.Error()}
 	}
+	return GCMResult{MessageId: sent.Name}
+}
+
+// an error for responses without a v1 error body, e.g. from a proxy in front of fcm
+func statusError(code int) string {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return "QuotaExceeded"
+	case code == http.StatusServiceUnavailable:
+		return "Unavailable"
+	case code >= 500:
+		return "InternalServerError"
+	}
+	return fmt.Sprintf("Non OK return status: %v", code)
+}
 
-	return &gcmResponse, nil
+// Retry-After is either seconds or an http date
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if wait := at.Sub(time.Now()); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// INVALID_ARGUMENT -> InvalidArgument, to match the legacy error strings
+func camelCase(code string) string {
+	words := strings.Split(strings.ToLower(code), "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, "")
 }
@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package gcm
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a fake token endpoint and fcm send endpoint. the token picks the answer.
+type fakeFCM struct {
+	server    *httptest.Server
+	mu        sync.Mutex
+	exchanges int
+	requests  []sendRequest
+}
+
+var fakeAnswers = map[string]struct {
+	status     int
+	retryAfter string
+	body       string
+}{
+	"ok":           {http.StatusOK, "", `{"name":"projects/p/messages/1"}`},
+	"unregistered": {http.StatusNotFound, "", `{"error":{"code":404,"status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`},
+	"garbage":      {http.StatusBadRequest, "", `{"error":{"code":400,"status":"INVALID_ARGUMENT","details":[{"@type":"type.googleapis.com/google.rpc.BadRequest","fieldViolations":[{"field":"message.token","description":"Invalid registration token"}]}]}}`},
+	"badmessage":   {http.StatusBadRequest, "", `{"error":{"code":400,"status":"INVALID_ARGUMENT","details":[{"@type":"type.googleapis.com/google.rpc.BadRequest","fieldViolations":[{"field":"message.android.ttl","description":"Invalid value"}]}]}}`},
+	"mismatch":     {http.StatusForbidden, "", `{"error":{"code":403,"status":"PERMISSION_DENIED","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"SENDER_ID_MISMATCH"}]}}`},
+	"quota":        {http.StatusTooManyRequests, "30", `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"QUOTA_EXCEEDED"}]}}`},
+	"unavailable":  {http.StatusServiceUnavailable, "10", `{"error":{"code":503,"status":"UNAVAILABLE"}}`},
+	"internal":     {http.StatusInternalServerError, "", `{"error":{"code":500,"status":"INTERNAL"}}`},
+	"proxy":        {http.StatusBadGateway, "", `<html>bad gateway</html>`},
+}
+
+func newFakeFCM(t *testing.T) *fakeFCM {
+	fake := &fakeFCM{}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || r.FormValue("assertion") == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fake.mu.Lock()
+			fake.exchanges++
+			fake.mu.Unlock()
+			fmt.Fprint(w, `{"access_token":"access","expires_in":3600,"token_type":"Bearer"}`)
+			return
+		}
+
+		if r.URL.Path != "/v1/projects/project/messages:send" {
+			t.Errorf("send to %v", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var request sendRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("decoding send: %v", err)
+			return
+		}
+		fake.mu.Lock()
+		fake.requests = append(fake.requests, request)
+		fake.mu.Unlock()
+
+		answer := fakeAnswers[request.Message.Token]
+		if answer.retryAfter != "" {
+			w.Header().Set("Retry-After", answer.retryAfter)
+		}
+		w.WriteHeader(answer.status)
+		fmt.Fprint(w, answer.body)
+	}))
+	return fake
+}
+
+// a GCM talking to fake. each test uses its own email so the shared token cache doesn't carry over.
+func (fake *fakeFCM) gcm(t *testing.T, email string) *GCM {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+
+	SendURL = fake.server.URL + "/v1/projects/%s/messages:send"
+	g, err := NewGCM(&ServiceAccount{
+		ProjectId:   "project",
+		ClientEmail: email,
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		TokenURI:    fake.server.URL + "/token",
+	}, fake.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestParseServiceAccount(t *testing.T) {
+	if _, err := ParseServiceAccount([]byte(`{"project_id":"p","client_email":"e"}`)); err == nil {
+		t.Errorf("accepted an account without a key")
+	}
+	account, err := ParseServiceAccount([]byte(`{"project_id":"p","client_email":"e","private_key":"k"}`))
+	if err != nil || account.ProjectId != "p" {
+		t.Errorf("ParseServiceAccount = %+v, %v", account, err)
+	}
+}
+
+func TestAccessTokenIsCached(t *testing.T) {
+	fake := newFakeFCM(t)
+	defer fake.server.Close()
+	g := fake.gcm(t, "cached@example.com")
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Send(map[string]interface{}{"a": 1}, []string{"ok", "ok"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fake.exchanges != 1 {
+		t.Errorf("%v token exchanges for three sends, want 1", fake.exchanges)
+	}
+
+	// an expired token is exchanged again
+	tokens.Lock()
+	cached := tokens.cache["cached@example.com"]
+	cached.expiry = time.Now().Add(-time.Second)
+	tokens.cache["cached@example.com"] = cached
+	tokens.Unlock()
+
+	if _, err := g.Send(map[string]interface{}{"a": 1}, []string{"ok"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.exchanges != 2 {
+		t.Errorf("%v token exchanges after expiry, want 2", fake.exchanges)
+	}
+}
+
+func TestSendResults(t *testing.T) {
+	fake := newFakeFCM(t)
+	defer fake.server.Close()
+	g := fake.gcm(t, "results@example.com")
+
+	tests := []struct {
+		token      string
+		err        string
+		retryAfter time.Duration
+	}{
+		{"ok", "", 0},
+		{"unregistered", "NotRegistered", 0},
+		{"garbage", "InvalidRegistration", 0},
+		{"badmessage", "InvalidArgument", 0},
+		{"mismatch", "MismatchSenderId", 0},
+		{"quota", "QuotaExceeded", time.Second * 30},
+		{"unavailable", "Unavailable", time.Second * 10},
+		{"internal", "InternalServerError", 0},
+		{"proxy", "InternalServerError", 0},
+	}
+
+	ids := make([]string, len(tests))
+	for i, test := range tests {
+		ids[i] = test.token
+	}
+
+	response, err := g.Send(map[string]interface{}{"video_id": 1}, ids, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Success != 1 || response.Failure != len(tests)-1 {
+		t.Errorf("success %v failure %v", response.Success, response.Failure)
+	}
+
+	for i, test := range tests {
+		result := response.Results[i]
+		if result.Error != test.err || result.RetryAfter != test.retryAfter {
+			t.Errorf("%v: got %q retry after %v, want %q retry after %v", test.token, result.Error, result.RetryAfter,
+				test.err, test.retryAfter)
+		}
+		if test.err == "" && result.MessageId == "" {
+			t.Errorf("%v: no message id", test.token)
+		}
+	}
+}
+
+func TestSendOptions(t *testing.T) {
+	fake := newFakeFCM(t)
+	defer fake.server.Close()
+	g := fake.gcm(t, "options@example.com")
+
+	_, err := g.Send(map[string]interface{}{"video_id": 42}, []string{"ok"}, &Options{
+		CollapseKey:           "new_video",
+		TimeToLive:            time.Hour,
+		Priority:              PriorityHigh,
+		RestrictedPackageName: "com.example.app",
+		DryRun:                true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := fake.requests[0]
+	if !request.ValidateOnly {
+		t.Errorf("dry run didn't set validate_only")
+	}
+	if request.Message.Data["video_id"] != "42" {
+		t.Errorf("data = %v, want string values", request.Message.Data)
+	}
+	want := AndroidConfig{CollapseKey: "new_video", Priority: "HIGH", TTL: "3600s", RestrictedPackageName: "com.example.app"}
+	if request.Message.Android == nil || *request.Message.Android != want {
+		t.Errorf("android = %+v, want %+v", request.Message.Android, want)
+	}
+}
+
+func TestAndroidConfig(t *testing.T) {
+	tests := []struct {
+		options *Options
+		want    *AndroidConfig
+	}{
+		{nil, nil},
+		{&Options{}, nil},
+		{&Options{DryRun: true, DelayWhileIdle: true}, nil},
+		{&Options{Priority: PriorityNormal}, &AndroidConfig{Priority: "NORMAL"}},
+		{&Options{Priority: "urgent"}, nil},
+		{&Options{TimeToLive: time.Minute + time.Millisecond}, &AndroidConfig{TTL: "60s"}},
+	}
+
+	for _, test := range tests {
+		got := androidConfig(test.options)
+		if (got == nil) != (test.want == nil) || (got != nil && *got != *test.want) {
+			t.Errorf("androidConfig(%+v) = %+v, want %+v", test.options, got, test.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if got := retryAfter(""); got != 0 {
+		t.Errorf("retryAfter(\"\") = %v", got)
+	}
+	if got := retryAfter("120"); got != time.Minute*2 {
+		t.Errorf("retryAfter(120) = %v", got)
+	}
+	if got := retryAfter("soon"); got != 0 {
+		t.Errorf("retryAfter(soon) = %v", got)
+	}
+	date := time.Now().Add(time.Minute * 5).UTC().Format(http.TimeFormat)
+	if got := retryAfter(date); got < time.Minute*4 || got > time.Minute*5 {
+		t.Errorf("retryAfter(%v) = %v", date, got)
+	}
+	past := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	if got := retryAfter(past); got != 0 {
+		t.Errorf("retryAfter(%v) = %v", past, got)
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	tests := map[string]string{
+		"INVALID_ARGUMENT":       "InvalidArgument",
+		"THIRD_PARTY_AUTH_ERROR": "ThirdPartyAuthError",
+		"UNKNOWN":                "Unknown",
+		"A__B":                   "AB",
+	}
+	for code, want := range tests {
+		if got := camelCase(code); got != want {
+			t.Errorf("camelCase(%v) = %v, want %v", code, got, want)
+		}
+	}
+}
+
+func TestStatusBadToken(t *testing.T) {
+	for token, want := range map[string]bool{"garbage": true, "badmessage": false, "quota": false} {
+		var status Status
+		if err := json.NewDecoder(strings.NewReader(fakeAnswers[token].body)).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		if got := status.BadToken(); got != want {
+			t.Errorf("%v: BadToken = %v, want %v", token, got, want)
+		}
+	}
+}
@@ -47,6 +47,31 @@ import (
 const GiantBombURL = "http://www.giantbomb.com/"
 const GiantBombApiURL = GiantBombURL + "api/"
 
+// format of publish_date and friends
+const DateLayout = "2006-01-02 15:04:05"
+
+// publish_date and friends are giantbomb's local time, with no zone given
+var Location = pacific()
+
+func pacific() *time.Location {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		// no zoneinfo. close enough outside daylight saving time.
+		return time.FixedZone("PST", -8*60*60)
+	}
+	return location
+}
+
+// read a publish_date style timestamp in giantbomb's time zone
+func ParseDate(value string) (time.Time, error) {
+	return time.ParseInLocation(DateLayout, value, Location)
+}
+
+// write t the way giantbomb writes publish_date, so it compares against stored dates as a string
+func FormatDate(t time.Time) string {
+	return t.In(Location).Format(DateLayout)
+}
+
 // markup for chat checks
 const LiveTitleMarkup = "<h4 class=\"grad-text\">Live on Giant Bomb!</h4>"
 const JoinButtonMarkup = "<p><button class=\"btn btn-primary\">Join the chat</button></p>"
@@ -59,6 +84,11 @@ const Header3CloseMarkup = "</h3>"
 // TODO move these into db
 type Video struct {
 	Retrieved time.Time `json:"-"`
+	// set once the video disappears upstream. removed videos are kept but hidden.
+	Removed   bool      `json:"-"`
+	RemovedAt time.Time `json:"-"`
+	// index terms for local search
+	SearchTerms []string `json:"-"`
 
 	Id            int64  `json:"id"`
 	Name          string `json:"name"`
@@ -74,6 +104,15 @@ type Image struct {
 	SuperUrl string `json:"super_url"`
 }
 
+type Game struct {
+	Id                  int64  `json:"id"`
+	Name                string `json:"name"`
+	Deck                string `json:"deck"`
+	Image               Image  `json:"image"`
+	OriginalReleaseDate string `json:"original_release_date"`
+	SiteDetailUrl       string `json:"site_detail_url"`
+}
+
 const StatusOK = 1
 const StatusRestrictedContent = 105
 
@@ -87,6 +126,15 @@ type BaseGiantBombResponse struct {
 	NumberOfTotalResults int64  `json:"number_of_total_results"`
 }
 
+func (r *BaseGiantBombResponse) Status() (int, string) {
+	return r.StatusCode, r.Error
+}
+
+// any of the responses below
+type GiantBombResponse interface {
+	Status() (int, string)
+}
+
 // anything
 type InterfaceGiantBombResponse struct {
 	BaseGiantBombResponse
@@ -99,12 +147,58 @@ type VideosGiantBombResponse struct {
 	Results []Video `json:"results"`
 }
 
+// Video
+type VideoGiantBombResponse struct {
+	BaseGiantBombResponse
+	Results Video `json:"results"`
+}
+
+// Games
+type GamesGiantBombResponse struct {
+	BaseGiantBombResponse
+	Results []Game `json:"results"`
+}
+
+// Game
+type GameGiantBombResponse struct {
+	BaseGiantBombResponse
+	Results Game `json:"results"`
+}
+
+type VideoType struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+	Deck string `json:"deck"`
+}
+
+// Video types
+type VideoTypesGiantBombResponse struct {
+	BaseGiantBombResponse
+	Results []VideoType `json:"results"`
+}
+
+// Search. only the fields common to every resource type.
+type SearchResult struct {
+	Id           int64  `json:"id"`
+	Name         string `json:"name"`
+	ResourceType string `json:"resource_type"`
+}
+
+type SearchGiantBombResponse struct {
+	BaseGiantBombResponse
+	Results []SearchResult `json:"results"`
+}
+
 type Chat struct {
 	Title     string
 	FirstSeen time.Time
 }
 
-func GetVideos(context appengine.Context, videoTypes []int, offset, limit int) (*VideosGiantBombResponse, error) {
+// sort orders for GetVideos. the api default is newest first.
+const SortNewest = ""
+const SortOldest = "id:asc"
+
+func GetVideos(context appengine.Context, videoTypes []int, offset, limit int, sort string) (*VideosGiantBombResponse, error) {
 	endpoint := GiantBombApiURL + "videos/"
 
 	values := url.Values{}
@@ -116,6 +210,71 @@ func GetVideos(context appengine.Context, videoTypes []int, offset, limit int) (
 	if limit > 0 {
 		values.Add("limit", strconv.Itoa(limit))
 	}
+	if sort != "" {
+		values.Add("sort", sort)
+	}
+
+	client := urlfetch.Client(context)
+
+	response, err := client.Get(endpoint + "?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var decoded VideosGiantBombResponse
+
+	decoder := json.NewDecoder(response.Body)
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	return &decoded, nil
+}
+
+func GetVideoTypes(context appengine.Context) (*VideoTypesGiantBombResponse, error) {
+	endpoint := GiantBombApiURL + "video_types/"
+
+	values := url.Values{}
+	values.Add("api_key", config.PullApiKey)
+	values.Add("format", "json")
+
+	client := urlfetch.Client(context)
+
+	response, err := client.Get(endpoint + "?" + values.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var decoded VideoTypesGiantBombResponse
+
+	decoder := json.NewDecoder(response.Body)
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	return &decoded, nil
+}
+
+// fetch specific videos, at most 100 at a time. videos that no longer exist are missing from the results.
+func GetVideosById(context appengine.Context, ids []int64) (*VideosGiantBombResponse, error) {
+	if len(ids) > 100 {
+		return nil, errors.New("Too many video ids")
+	}
+
+	filter := make([]string, len(ids))
+	for i, id := range ids {
+		filter[i] = strconv.FormatInt(id, 10)
+	}
+
+	endpoint := GiantBombApiURL + "videos/"
+
+	values := url.Values{}
+	values.Add("api_key", config.PullApiKey)
+	values.Add("format", "json")
+	values.Add("limit", "100")
+	values.Add("filter", "id:"+strings.Join(filter, "|"))
 
 	client := urlfetch.Client(context)
 
@@ -31,6 +31,7 @@
 package luchadeer
 
 import (
+	"luchadeer/admin"
 	"luchadeer/api"
 	"luchadeer/config"
 	"luchadeer/cron"
@@ -39,6 +40,7 @@ import (
 )
 
 func init() {
+	admin.Init()
 	api.Init()
 	cron.Init()
 	tasks.Init()
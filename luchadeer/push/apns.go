@@ -0,0 +1,159 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package push
+
+import (
+	"luchadeer/apns"
+	"luchadeer/client"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how many requests an APNsProvider has in flight at once. apns has no multicast, every token is a request.
+const apnsConcurrency = 20
+
+type APNsProvider struct {
+	apns *apns.APNs
+}
+
+func NewAPNsProvider(a *apns.APNs) *APNsProvider {
+	return &APNsProvider{a}
+}
+
+func (p *APNsProvider) Platform() string {
+	return client.PlatformIOS
+}
+
+func (p *APNsProvider) MaxBatch() int {
+	return 1000
+}
+
+// data goes out as custom keys alongside the aps dictionary. an alert is shown by the system. without one the push
+// is content-available only and the app decides what to do with it.
+func apnsPayload(message *Message) map[string]interface{} {
+	aps := map[string]interface{}{"content-available": 1}
+	if message.Alert != nil {
+		aps = map[string]interface{}{
+			"alert": map[string]interface{}{"title": message.Alert.Title, "body": message.Alert.Body},
+			"sound": "default",
+		}
+	}
+
+	payload := map[string]interface{}{"aps": aps}
+	for k, v := range message.Data {
+		payload[k] = v
+	}
+	return payload
+}
+
+// ios throttles background pushes and drops them for apps that were force quit, so anything the user should see
+// goes out as an alert. background pushes have to go out at priority 5 whatever the message asks for.
+func apnsOptions(message *Message) *apns.Options {
+	options := &apns.Options{PushType: "background", Priority: 5, CollapseId: message.CollapseKey}
+	if message.Alert != nil {
+		options.PushType = "alert"
+		if message.Priority == PriorityHigh {
+			options.Priority = 10
+		}
+	}
+	if message.TimeToLive > 0 {
+		options.Expiration = time.Now().Add(message.TimeToLive)
+	}
+	return options
+}
+
+func (p *APNsProvider) Send(message *Message, tokens []string) ([]Result, error) {
+	if len(tokens) > p.MaxBatch() {
+		return nil, ErrBatchTooLarge
+	}
+
+	// apns has no dry run, so validate what we can locally and send nothing
+	if message.DryRun {
+		results := make([]Result, len(tokens))
+		for i, token := range tokens {
+			results[i].Token = token
+			if !client.ValidToken(client.PlatformIOS, token) {
+				results[i].Error = ErrorInvalidRegistration
+			} else {
+				results[i].FormatOnly = true
+			}
+		}
+		return results, nil
+	}
+
+	payload := apnsPayload(message)
+	options := apnsOptions(message)
+
+	results := make([]Result, len(tokens))
+	sem := make(chan bool, apnsConcurrency)
+	var wg sync.WaitGroup
+
+	for i, token := range tokens {
+		wg.Add(1)
+		sem <- true
+		go func(i int, token string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i].Token = token
+			response, err := p.apns.Send(token, payload, options)
+			if err != nil {
+				results[i].Error = ErrorUnavailable
+				return
+			}
+			results[i].MessageId = response.ApnsId
+			results[i].Error = apnsError(response)
+			results[i].RetryAfter = response.RetryAfter
+		}(i, token)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+func apnsError(response *apns.Response) string {
+	switch {
+	case response.StatusCode == http.StatusOK:
+		return ""
+	case response.StatusCode == http.StatusGone || response.Reason == "Unregistered":
+		return ErrorNotRegistered
+	case response.Reason == "BadDeviceToken" || response.Reason == "DeviceTokenNotForTopic":
+		return ErrorInvalidRegistration
+	case response.StatusCode == http.StatusTooManyRequests:
+		return ErrorQuotaExceeded
+	case response.StatusCode == http.StatusServiceUnavailable:
+		return ErrorUnavailable
+	case response.StatusCode >= 500:
+		return ErrorInternal
+	}
+	return response.Reason
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package push
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/net/http2"
+	"luchadeer/apns"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a push as the fake apns server got it
+type sentPush struct {
+	pushType string
+	priority string
+	payload  map[string]interface{}
+}
+
+func fakeAPNsProvider(t *testing.T) (*APNsProvider, map[string]*sentPush, func()) {
+	var mu sync.Mutex
+	sent := map[string]*sentPush{}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		push := &sentPush{pushType: r.Header.Get("apns-push-type"), priority: r.Header.Get("apns-priority")}
+		if err := json.NewDecoder(r.Body).Decode(&push.payload); err != nil {
+			t.Errorf("decoding payload: %v", err)
+		}
+		mu.Lock()
+		sent[token] = push
+		mu.Unlock()
+
+		switch token {
+		case "ok":
+			w.WriteHeader(http.StatusOK)
+		case "gone":
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprint(w, `{"reason":"Unregistered"}`)
+		case "bad":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"reason":"BadDeviceToken"}`)
+		case "busy":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"reason":"TooManyRequests"}`)
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	client := &http.Client{Transport: &http2.Transport{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}}
+	a, err := apns.NewAPNs(server.URL, "KEYID", "TEAMID", "com.example.app", keyPEM, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewAPNsProvider(a), sent, server.Close
+}
+
+func TestAPNsProviderResults(t *testing.T) {
+	provider, _, done := fakeAPNsProvider(t)
+	defer done()
+
+	tokens := []string{"ok", "gone", "bad", "busy"}
+	results, err := provider.Send(&Message{Data: map[string]interface{}{"video_id": 1}}, tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		err        string
+		dead       bool
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{"", false, false, 0},
+		{ErrorNotRegistered, true, false, 0},
+		{ErrorInvalidRegistration, true, false, 0},
+		{ErrorQuotaExceeded, false, true, time.Second * 30},
+	}
+
+	for i, result := range results {
+		if result.Token != tokens[i] {
+			t.Errorf("result %v is for %q, want %q", i, result.Token, tokens[i])
+		}
+		if result.Error != want[i].err || result.Dead() != want[i].dead || result.Retryable() != want[i].retryable ||
+			result.RetryAfter != want[i].retryAfter {
+			t.Errorf("%v: got %q dead %v retryable %v retry after %v, want %+v", tokens[i],
+				result.Error, result.Dead(), result.Retryable(), result.RetryAfter, want[i])
+		}
+	}
+
+	counts := Count(results)
+	if counts.Success != 1 || counts.Failure != 3 {
+		t.Errorf("Count = %+v", counts)
+	}
+}
+
+func TestAPNsPushTypes(t *testing.T) {
+	provider, sent, done := fakeAPNsProvider(t)
+	defer done()
+
+	tests := []struct {
+		name     string
+		message  *Message
+		pushType string
+		priority string
+	}{
+		{"alert", &Message{
+			Data:     map[string]interface{}{"video_id": "1"},
+			Alert:    &Alert{Title: "New in Quick Looks", Body: "Quick Look: Zelda"},
+			Priority: PriorityHigh,
+		}, "alert", "10"},
+		{"normal alert", &Message{
+			Data:     map[string]interface{}{"video_id": "1"},
+			Alert:    &Alert{Title: "New in Quick Looks", Body: "Quick Look: Zelda"},
+			Priority: PriorityNormal,
+		}, "alert", "5"},
+		{"silent", &Message{
+			Data:     map[string]interface{}{"action": "video_removed", "video_id": "1"},
+			Priority: PriorityHigh,
+		}, "background", "5"},
+	}
+
+	for _, test := range tests {
+		if _, err := provider.Send(test.message, []string{"ok"}); err != nil {
+			t.Fatal(err)
+		}
+
+		push := sent["ok"]
+		if push.pushType != test.pushType || push.priority != test.priority {
+			t.Errorf("%v: sent as %v at priority %v, want %v at %v", test.name, push.pushType, push.priority,
+				test.pushType, test.priority)
+		}
+		if push.payload["video_id"] != "1" {
+			t.Errorf("%v: data missing from payload %v", test.name, push.payload)
+		}
+
+		aps, _ := push.payload["aps"].(map[string]interface{})
+		if test.message.Alert == nil {
+			if aps["content-available"] != float64(1) || aps["alert"] != nil {
+				t.Errorf("%v: aps = %v, want content-available only", test.name, aps)
+			}
+			continue
+		}
+		alert, _ := aps["alert"].(map[string]interface{})
+		if alert["title"] != test.message.Alert.Title || alert["body"] != test.message.Alert.Body {
+			t.Errorf("%v: alert = %v, want %+v", test.name, alert, test.message.Alert)
+		}
+		if aps["content-available"] != nil {
+			t.Errorf("%v: alert push is also content-available", test.name)
+		}
+	}
+}
+
+func TestAPNsDryRunChecksTokenFormat(t *testing.T) {
+	provider := NewAPNsProvider(nil)
+	good := strings.Repeat("ab", 32)
+
+	results, err := provider.Send(&Message{DryRun: true}, []string{good, "not-a-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != "" || !results[0].FormatOnly || results[1].Error != ErrorInvalidRegistration {
+		t.Errorf("dry run results = %+v", results)
+	}
+}
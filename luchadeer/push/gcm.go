@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package push
+
+import (
+	"luchadeer/client"
+	"luchadeer/gcm"
+)
+
+type GCMProvider struct {
+	gcm         *gcm.GCM
+	packageName string
+}
+
+// packageName restricts delivery to that app, leave it blank to allow any
+func NewGCMProvider(g *gcm.GCM, packageName string) *GCMProvider {
+	return &GCMProvider{g, packageName}
+}
+
+func (p *GCMProvider) Platform() string {
+	return client.PlatformAndroid
+}
+
+func (p *GCMProvider) MaxBatch() int {
+	return 1000
+}
+
+func (p *GCMProvider) Send(message *Message, tokens []string) ([]Result, error) {
+	if len(tokens) > p.MaxBatch() {
+		return nil, ErrBatchTooLarge
+	}
+
+	response, err := p.gcm.Send(message.Data, tokens, &gcm.Options{
+		CollapseKey:           message.CollapseKey,
+		TimeToLive:            message.TimeToLive,
+		Priority:              message.Priority,
+		DelayWhileIdle:        message.DelayWhileIdle,
+		RestrictedPackageName: p.packageName,
+		DryRun:                message.DryRun,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// gcm's error strings are the ones we normalize to
+	results := make([]Result, len(tokens))
+	for i, token := range tokens {
+		results[i].Token = token
+		if i < len(response.Results) {
+			results[i].MessageId = response.Results[i].MessageId
+			results[i].CanonicalToken = response.Results[i].RegistrationId
+			results[i].Error = response.Results[i].Error
+			results[i].RetryAfter = response.Results[i].RetryAfter
+		} else {
+			results[i].Error = ErrorInternal
+		}
+	}
+	return results, nil
+}
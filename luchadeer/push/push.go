@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package push
+
+import (
+	"errors"
+	"time"
+)
+
+// what gets sent. providers turn Data into whatever their platform expects.
+type Message struct {
+	Data map[string]interface{} `json:"data"`
+
+	// delivery options every provider understands in some form. zero values leave the provider default.
+	CollapseKey    string        `json:"collapse_key,omitempty"`     // pending messages with the same key replace each other
+	TimeToLive     time.Duration `json:"time_to_live,omitempty"`     // drop the message if it can't be delivered in this long
+	Priority       string        `json:"priority,omitempty"`         // PriorityHigh or PriorityNormal
+	DelayWhileIdle bool          `json:"delay_while_idle,omitempty"` // gcm only
+	DryRun         bool          `json:"dry_run,omitempty"`          // validate without delivering
+
+	// what to show for platforms where the system shows the push, not the app. nil sends a silent push the app
+	// handles in the background.
+	Alert *Alert `json:"alert,omitempty"`
+}
+
+type Alert struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+const PriorityHigh = "high"
+const PriorityNormal = "normal"
+
+// per token errors, normalized across providers. anything else is passed through as the provider reported it.
+const ErrorNotRegistered = "NotRegistered"
+const ErrorInvalidRegistration = "InvalidRegistration"
+const ErrorUnavailable = "Unavailable"
+const ErrorInternal = "InternalServerError"
+const ErrorQuotaExceeded = "QuotaExceeded"
+
+// the outcome of sending to one token
+type Result struct {
+	Token          string
+	MessageId      string
+	CanonicalToken string // the token the provider wants used from now on, if it changed
+	Error          string
+	RetryAfter     time.Duration // how long the provider asked us to wait before retrying, if it did
+	FormatOnly     bool          // a dry run only checked the token's format, the provider never saw it
+}
+
+// the token will never work again and should be forgotten
+func (r *Result) Dead() bool {
+	return r.Error == ErrorNotRegistered || r.Error == ErrorInvalidRegistration
+}
+
+// the failure was the provider's, sending again later may work
+func (r *Result) Retryable() bool {
+	return r.Error == ErrorUnavailable || r.Error == ErrorInternal || r.Error == ErrorQuotaExceeded
+}
+
+// a push service for one platform
+type Provider interface {
+	Platform() string
+	// most tokens Send accepts at once
+	MaxBatch() int
+	// results line up with tokens. an error means nothing was sent.
+	Send(message *Message, tokens []string) ([]Result, error)
+}
+
+var ErrBatchTooLarge = errors.New("Too many tokens for one send")
+
+// tally of a batch of results
+type Counts struct {
+	Success   int
+	Failure   int
+	Canonical int
+	Removed   int            // dead tokens whose preferences were deleted
+	Replaced  int            // canonical tokens written over the old ones
+	Retried   int            // failed tokens queued to be sent again
+	Errors    map[string]int // failures by error
+}
+
+func Count(results []Result) Counts {
+	counts := Counts{Errors: map[string]int{}}
+	for _, result := range results {
+		if result.Error != "" {
+			counts.Failure++
+			counts.Errors[result.Error]++
+		} else {
+			counts.Success++
+		}
+		if result.CanonicalToken != "" {
+			counts.Canonical++
+		}
+	}
+	return counts
+}
+
+func (c *Counts) Add(other Counts) {
+	c.Success += other.Success
+	c.Failure += other.Failure
+	c.Canonical += other.Canonical
+	c.Removed += other.Removed
+	c.Replaced += other.Replaced
+	c.Retried += other.Retried
+	if c.Errors == nil {
+		c.Errors = map[string]int{}
+	}
+	for err, n := range other.Errors {
+		c.Errors[err] += n
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// prefix terms are marked so they can't collide with a stemmed word
+const prefixMarker = "~"
+
+// shortest and longest prefix indexed for prefix matching
+const minPrefix = 2
+const maxPrefix = 10
+
+var stopWords = map[string]bool{
+	"an":   true,
+	"and":  true,
+	"are":  true,
+	"as":   true,
+	"at":   true,
+	"be":   true,
+	"by":   true,
+	"for":  true,
+	"from": true,
+	"in":   true,
+	"is":   true,
+	"it":   true,
+	"of":   true,
+	"on":   true,
+	"or":   true,
+	"the":  true,
+	"to":   true,
+	"with": true,
+}
+
+// split text into lowercase words, dropping punctuation and single letters. numbers are kept whatever their length,
+// there are a lot of sequels.
+func Words(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	words := []string{}
+	for _, field := range fields {
+		if len([]rune(field)) < 2 && !unicode.IsDigit([]rune(field)[0]) {
+			continue
+		}
+		words = append(words, field)
+	}
+	return words
+}
+
+// a light suffix stripper, enough that "reviews" finds "review" and "running" finds "run".
+func Stem(word string) string {
+	if len(word) <= 3 || !isAlpha(word) {
+		return word
+	}
+
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		return word[:len(word)-2]
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		return word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"), strings.HasSuffix(word, "is"):
+		return word
+	case strings.HasSuffix(word, "s"):
+		return word[:len(word)-1]
+	case strings.HasSuffix(word, "ing"):
+		return stripSuffix(word, "ing")
+	case strings.HasSuffix(word, "ed"):
+		return stripSuffix(word, "ed")
+	case strings.HasSuffix(word, "ly") && len(word) > 4:
+		return word[:len(word)-2]
+	}
+	return word
+}
+
+// strip a verb suffix as long as what's left still looks like a word, and undouble the final consonant
+func stripSuffix(word, suffix string) string {
+	stem := word[:len(word)-len(suffix)]
+	if len(stem) < 3 || !strings.ContainsAny(stem, "aeiouy") {
+		return word
+	}
+	if n := len(stem); stem[n-1] == stem[n-2] && !strings.ContainsRune("aeiouls", rune(stem[n-1])) {
+		stem = stem[:n-1]
+	}
+	return stem
+}
+
+func isAlpha(word string) bool {
+	for _, r := range word {
+		if r < 'a' || r > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// index terms for a document. every non stop word of title and body is stemmed, and the words of the title also
+// get prefix terms so partially typed queries match.
+func Terms(title, body string) []string {
+	seen := map[string]bool{}
+	terms := []string{}
+	add := func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	titleWords := Words(title)
+	for _, word := range append(titleWords, Words(body)...) {
+		if !stopWords[word] {
+			add(Stem(word))
+		}
+	}
+
+	for _, word := range titleWords {
+		runes := []rune(word)
+		for n := minPrefix; n < len(runes) && n <= maxPrefix; n++ {
+			add(prefixMarker + string(runes[:n]))
+		}
+	}
+
+	return terms
+}
+
+// turn a query into groups of terms. a document matches if it has at least one term from every group. the last word
+// also matches as a prefix, unless the query ends in a space.
+func QueryTerms(query string) [][]string {
+	words := Words(query)
+
+	groups := [][]string{}
+	for i, word := range words {
+		group := []string{}
+		if !stopWords[word] {
+			group = append(group, Stem(word))
+		}
+		if i == len(words)-1 && !strings.HasSuffix(query, " ") {
+			if runes := []rune(word); len(runes) >= minPrefix && len(runes) <= maxPrefix {
+				group = append(group, prefixMarker+word)
+			}
+		}
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
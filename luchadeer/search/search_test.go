@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"reviews", "review"},
+		{"games", "game"},
+		{"stories", "story"},
+		{"ties", "tie"},
+		{"classes", "class"},
+		{"class", "class"},
+		{"bonus", "bonus"},
+		{"this", "this"},
+		{"running", "run"},
+		{"falling", "fall"},
+		{"sing", "sing"},
+		{"played", "play"},
+		{"bed", "bed"},
+		{"quickly", "quick"},
+		{"ps4", "ps4"},
+		{"2014", "2014"},
+	}
+
+	for _, test := range tests {
+		if got := Stem(test.word); got != test.want {
+			t.Errorf("Stem(%v) = %v, want %v", test.word, got, test.want)
+		}
+	}
+}
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"Quick Look: Zelda", []string{"quick", "look", "zelda"}},
+		{"Mario Kart 8 - a race", []string{"mario", "kart", "8", "race"}},
+		{"Pokémon X/Y", []string{"pokémon"}},
+	}
+
+	for _, test := range tests {
+		if got := Words(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Words(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestTerms(t *testing.T) {
+	tests := []struct {
+		title string
+		body  string
+		want  []string
+	}{
+		{"", "", []string{}},
+		{"Quick Look: Zelda", "the dungeons", []string{
+			"quick", "look", "zelda", "dungeon",
+			"~qu", "~qui", "~quic", "~lo", "~loo", "~ze", "~zel", "~zeld",
+		}},
+		{"Mario Kart 8", "", []string{"mario", "kart", "8", "~ma", "~mar", "~mari", "~ka", "~kar"}},
+		{"Games games", "", []string{"game", "~ga", "~gam", "~game"}},
+		{"Extraordinarily", "", []string{"extraordinari", "~ex", "~ext", "~extr", "~extra", "~extrao", "~extraor",
+			"~extraord", "~extraordi", "~extraordin"}},
+	}
+
+	for _, test := range tests {
+		if got := Terms(test.title, test.body); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Terms(%q, %q) = %q, want %q", test.title, test.body, got, test.want)
+		}
+	}
+}
+
+func TestQueryTerms(t *testing.T) {
+	tests := []struct {
+		query string
+		want  [][]string
+	}{
+		{"", [][]string{}},
+		{"zelda rev", [][]string{{"zelda"}, {"rev", "~rev"}}},
+		{"zelda rev ", [][]string{{"zelda"}, {"rev"}}},
+		{"quick looks", [][]string{{"quick"}, {"look", "~looks"}}},
+		{"the", [][]string{{"~the"}}},
+		{"of the", [][]string{{"~the"}}},
+	}
+
+	for _, test := range tests {
+		if got := QueryTerms(test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("QueryTerms(%q) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
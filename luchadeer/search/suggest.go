@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package search
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// a completion and how highly it ranks
+type Suggestion struct {
+	Text  string  `json:"t"`
+	Score float64 `json:"s"`
+}
+
+// lowercase text and collapse everything that isn't a letter or digit into single spaces.
+func Normalize(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
+
+// Vocabulary is the stemmed words of a set of texts, e.g. video and game names.
+type Vocabulary map[string]bool
+
+func (v Vocabulary) Add(text string) {
+	for _, word := range Words(text) {
+		if !stopWords[word] {
+			v[Stem(word)] = true
+		}
+	}
+}
+
+// whether every word of text that isn't a stop word is in the vocabulary, and there is at least one.
+func (v Vocabulary) Covers(text string) bool {
+	known := 0
+	for _, word := range Words(text) {
+		if stopWords[word] {
+			continue
+		}
+		if !v[Stem(word)] {
+			return false
+		}
+		known++
+	}
+	return known > 0
+}
+
+type suggesterEntry struct {
+	key        string
+	suggestion *Suggestion
+}
+
+// Suggester completes prefixes from a fixed set of suggestions. it keeps a sorted list of every normalized
+// suggestion and every word-started tail of one, so "zel" completes "The Legend of Zelda", and a prefix lookup is a
+// binary search followed by a scan of the matching range.
+type Suggester struct {
+	entries []suggesterEntry
+}
+
+func NewSuggester(suggestions []Suggestion) *Suggester {
+	entries := []suggesterEntry{}
+	for i := range suggestions {
+		suggestion := &suggestions[i]
+		words := strings.Split(Normalize(suggestion.Text), " ")
+		for w := range words {
+			entries = append(entries, suggesterEntry{strings.Join(words[w:], " "), suggestion})
+		}
+	}
+
+	sort.Sort(byKey(entries))
+
+	return &Suggester{entries}
+}
+
+// up to n suggestions starting with prefix, best first.
+func (s *Suggester) Complete(prefix string, n int) []string {
+	prefix = Normalize(prefix)
+	if prefix == "" {
+		return []string{}
+	}
+
+	matches := []*Suggestion{}
+	seen := map[*Suggestion]bool{}
+	for i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].key >= prefix }); i < len(s.entries); i++ {
+		entry := s.entries[i]
+		if !strings.HasPrefix(entry.key, prefix) {
+			break
+		}
+		if !seen[entry.suggestion] {
+			seen[entry.suggestion] = true
+			matches = append(matches, entry.suggestion)
+		}
+	}
+
+	sort.Sort(byScore(matches))
+
+	completions := []string{}
+	for i := 0; i < len(matches) && i < n; i++ {
+		completions = append(completions, matches[i].Text)
+	}
+	return completions
+}
+
+type byKey []suggesterEntry
+
+func (s byKey) Len() int           { return len(s) }
+func (s byKey) Less(i, j int) bool { return s[i].key < s[j].key }
+func (s byKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byScore []*Suggestion
+
+func (s byScore) Len() int           { return len(s) }
+func (s byScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
+func (s byScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
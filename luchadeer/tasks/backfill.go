@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tasks
+
+import (
+	"appengine"
+	"appengine/taskqueue"
+	"errors"
+	"fmt"
+	"luchadeer/config"
+	"luchadeer/db"
+	"luchadeer/giantbomb"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const BACKFILL_VIDEOS_URL = "/task/backfill_videos"
+
+var errBackfillStopped = errors.New("Backfill is not running")
+
+// start walking the giantbomb video archive oldest first, one page per task. a stopped or finished backfill picks
+// up where it left off unless restart is set.
+func StartVideoBackfill(context appengine.Context, restart bool) (*db.BackfillState, error) {
+	state, err := db.UpdateBackfillState(context, func(state *db.BackfillState) error {
+		if restart || state.Started.IsZero() {
+			state.Offset = 0
+			state.Stored = 0
+			state.Started = time.Now()
+		}
+		state.Running = true
+		state.Run++
+		state.Finished = time.Time{}
+		state.LastError = ""
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := queueBackfillPage(context, state, 0); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// any page task already queued sees the stop and drops out.
+func StopVideoBackfill(context appengine.Context) (*db.BackfillState, error) {
+	return db.UpdateBackfillState(context, func(state *db.BackfillState) error {
+		state.Running = false
+		return nil
+	})
+}
+
+func queueBackfillPage(context appengine.Context, state *db.BackfillState, delay time.Duration) error {
+	task := taskqueue.NewPOSTTask(
+		BACKFILL_VIDEOS_URL,
+		map[string][]string{
+			"run": {strconv.Itoa(state.Run)},
+		},
+	)
+	// named so a retried page can't fork the chain
+	task.Name = fmt.Sprintf("backfill-videos-%d-%d", state.Run, state.Offset)
+	task.Delay = delay
+
+	if _, err := taskqueue.Add(context, task, ""); err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+		return err
+	}
+	return nil
+}
+
+func backfillVideos(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	run, _ := strconv.Atoi(r.FormValue("run"))
+
+	state, err := db.GetBackfillState(context)
+	if err != nil {
+		context.Errorf("GetBackfillState: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	if !state.Running || state.Run != run {
+		context.Infof("Dropping backfill task for run %v", run)
+		return
+	}
+
+	response, err := giantbomb.GetVideos(context, nil, state.Offset, config.BackfillPageSize, giantbomb.SortOldest)
+	if err == nil && response.StatusCode != giantbomb.StatusOK {
+		err = fmt.Errorf("Bad status returned by content provider: %v: %v", response.StatusCode, response.Error)
+	}
+	if err != nil {
+		context.Errorf("Backfill page at %v failed: %v", state.Offset, err)
+		db.UpdateBackfillState(context, func(state *db.BackfillState) error {
+			state.LastError = err.Error()
+			return nil
+		})
+		// let the queue retry with backoff
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	videos := response.Results
+
+	// no push notifications for anything found here, the pull handles new videos.
+	newVideos, revisions, err := db.SyncVideos(context, videos)
+	if err != nil {
+		context.Errorf("SyncVideos: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	context.Infof("Backfill page at %v: New: %v, Changed: %v", state.Offset, len(newVideos), len(revisions))
+
+	state, err = db.UpdateBackfillState(context, func(state *db.BackfillState) error {
+		if !state.Running || state.Run != run {
+			return errBackfillStopped
+		}
+		state.Offset += len(videos)
+		state.Stored += len(videos)
+		state.Total = response.NumberOfTotalResults
+		state.LastError = ""
+		if len(videos) < config.BackfillPageSize || int64(state.Offset) >= state.Total {
+			state.Running = false
+			state.Finished = time.Now()
+		}
+		return nil
+	})
+	if err == errBackfillStopped {
+		context.Infof("Backfill run %v was stopped", run)
+		return
+	}
+	if err != nil {
+		context.Errorf("UpdateBackfillState: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	context.Infof("Backfill: %v of %v", state.Offset, state.Total)
+
+	if !state.Running {
+		context.Infof("Backfill finished, stored %v videos", state.Stored)
+		return
+	}
+
+	if err := queueBackfillPage(context, state, time.Hour/config.BackfillRequestsPerHour); err != nil {
+		context.Errorf("queueBackfillPage: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+	}
+}
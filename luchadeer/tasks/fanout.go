@@ -0,0 +1,286 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tasks
+
+import (
+	"appengine"
+	"appengine/taskqueue"
+	"encoding/json"
+	"fmt"
+	"luchadeer/db"
+	"luchadeer/flags"
+	"luchadeer/push"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const PUSH_WALK_URL = "/task/push_walk"
+const PUSH_PAGE_URL = "/task/push_page"
+
+// subscribers per page task. also the most tokens any provider takes at once.
+const fanOutPageSize = 1000
+
+// pages a walk task queues before handing off to the next one
+const walkPagesPerTask = 50
+
+// a push goes out in three steps. fanOut records the notification, a chain of walk tasks steps through the
+// subscribers with keys only queries and queues a page task per fanOutPageSize of them, and the page tasks send
+// in parallel and record how they went.
+//
+// key identifies what's being pushed. a key that was already fanned out is only walked again from the start, which
+// the task names turn into a no-op, so a retried push task can't send twice. an error means the push task should be
+// retried.
+func fanOut(context appengine.Context, key, category string, message *push.Message) error {
+	marshalled, err := json.Marshal(message)
+	if err != nil {
+		// retrying won't help
+		context.Errorf("Couldn't marshal push: %v", err)
+		return nil
+	}
+
+	notification := &db.PushNotification{Key: key, Category: category, Message: marshalled, Created: time.Now()}
+	created, err := db.CreatePushNotification(context, notification)
+	if err != nil {
+		return fmt.Errorf("CreatePushNotification: %v", err)
+	}
+	if !created {
+		context.Infof("Push %v was already fanned out", key)
+	}
+
+	if err := queueWalk(context, key, 0, ""); err != nil {
+		return fmt.Errorf("Couldn't queue push walk for %v: %v", key, err)
+	}
+	return nil
+}
+
+// walk and page tasks are named after their notification and page, so a retried walk can't queue a page twice
+func queueWalk(context appengine.Context, notification string, page int, cursor string) error {
+	task := taskqueue.NewPOSTTask(
+		PUSH_WALK_URL,
+		map[string][]string{
+			"notification": {notification},
+			"page":         {strconv.Itoa(page)},
+			"cursor":       {cursor},
+		},
+	)
+	task.Name = fmt.Sprintf("push-walk-%s-%d", notification, page)
+
+	if _, err := taskqueue.Add(context, task, ""); err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+		return err
+	}
+	return nil
+}
+
+// a page runs from the start cursor to the end cursor, or to the last subscriber if end is empty
+func queuePage(context appengine.Context, notification string, page int, start, end string) error {
+	task := taskqueue.NewPOSTTask(
+		PUSH_PAGE_URL,
+		map[string][]string{
+			"notification": {notification},
+			"page":         {strconv.Itoa(page)},
+			"start":        {start},
+			"end":          {end},
+		},
+	)
+	task.Name = fmt.Sprintf("push-page-%s-%d", notification, page)
+
+	if _, err := taskqueue.Add(context, task, ""); err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+		return err
+	}
+	return nil
+}
+
+func pushWalk(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	id := r.FormValue("notification")
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	cursor := r.FormValue("cursor")
+
+	notification, err := db.GetPushNotification(context, id)
+	if err != nil {
+		context.Errorf("GetPushNotification %v: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := 0; i < walkPagesPerTask; i++ {
+		next, n, err := db.SkipNotificationSubscriptions(context, notification.Category, cursor, fanOutPageSize)
+		if err != nil {
+			context.Errorf("SkipNotificationSubscriptions: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if n > 0 {
+			if err := queuePage(context, id, page, cursor, next); err != nil {
+				context.Errorf("Couldn't queue push page %v-%v: %v", id, page, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			page++
+		}
+
+		if next == "" || n < fanOutPageSize {
+			notification.Walked = true
+			notification.Pages = page
+			if err := db.PutPushNotification(context, notification); err != nil {
+				context.Errorf("PutPushNotification: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			context.Infof("Push %v to %v queued %v pages", id, notification.Category, page)
+			finishIfDone(context, notification.Key)
+			return
+		}
+		cursor = next
+	}
+
+	if err := queueWalk(context, id, page, cursor); err != nil {
+		context.Errorf("Couldn't queue push walk for %v: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func pushPage(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	id := r.FormValue("notification")
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	start := r.FormValue("start")
+	end := r.FormValue("end")
+
+	providers := providers(context)
+	if len(providers) == 0 {
+		return
+	}
+
+	notification, err := db.GetPushNotification(context, id)
+	if err != nil {
+		context.Errorf("GetPushNotification %v: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var message push.Message
+	if err := json.Unmarshal(notification.Message, &message); err != nil {
+		context.Errorf("Couldn't unmarshal push %v: %v", id, err)
+		return
+	}
+
+	preferences, err := db.NotificationSubscriptionsPage(context, notification.Category, start, end)
+	if err != nil {
+		context.Errorf("NotificationSubscriptionsPage: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	set, err := flags.Load(context)
+	if err != nil {
+		context.Errorf("Couldn't load flags for push: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]string, len(preferences))
+	for i := range preferences {
+		ids[i] = preferences[i].GCMRegistrationId
+	}
+	known, err := db.GetDevices(context, ids)
+	if err != nil {
+		// only version targeting needs them
+		context.Errorf("GetDevices: %v", err)
+	}
+
+	tokens := tokensFor(set, preferences, known)
+	counts := pushAttempt(context, id, providers, tokens, &message, 1)
+
+	devices := 0
+	for _, platformTokens := range tokens {
+		devices += len(platformTokens)
+	}
+
+	err = db.PutPushPage(context, &db.PushPage{
+		Notification: id,
+		Page:         page,
+		PushStats: db.PushStats{
+			Devices:   devices,
+			Success:   counts.Success,
+			Failure:   counts.Failure,
+			Canonical: counts.Canonical,
+			Removed:   counts.Removed,
+			Replaced:  counts.Replaced,
+			Retried:   counts.Retried,
+		},
+	})
+	if err != nil {
+		// the push went out, so don't let the page be retried over it
+		context.Errorf("PutPushPage %v-%v: %v", id, page, err)
+		return
+	}
+
+	finishIfDone(context, notification.Key)
+}
+
+// once the last page of a notification is in, record the totals on it. the notification is fetched again since the
+// walk may have finished since the caller loaded it.
+func finishIfDone(context appengine.Context, key string) {
+	notification, err := db.GetPushNotification(context, key)
+	if err != nil {
+		context.Errorf("GetPushNotification %v: %v", key, err)
+		return
+	}
+	if !notification.Walked || !notification.Finished.IsZero() {
+		return
+	}
+
+	pages, err := db.GetPushPages(context, notification.Key, notification.Pages)
+	if err != nil {
+		context.Errorf("GetPushPages: %v", err)
+		return
+	}
+	if len(pages) < notification.Pages {
+		return
+	}
+
+	notification.PushStats = db.PushStats{}
+	for i := range pages {
+		notification.Add(&pages[i].PushStats)
+	}
+	notification.Finished = time.Now()
+
+	if err := db.PutPushNotification(context, notification); err != nil {
+		context.Errorf("PutPushNotification: %v", err)
+	}
+	context.Infof("Push %v to %v finished in %v: %+v", notification.Key, notification.Category,
+		notification.Finished.Sub(notification.Created), notification.PushStats)
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tasks
+
+import (
+	"appengine"
+	"luchadeer/config"
+	"luchadeer/db"
+	"luchadeer/push"
+	"time"
+)
+
+// most tokens of each kind a report lists. the counts are always complete.
+const pruneReportTokens = 100
+
+// what a prune did, or with DryRun, would have done
+type PruneReport struct {
+	DryRun     bool `json:"dry_run"`
+	Scanned    int  `json:"scanned"`     // stale preferences looked at
+	Active     int  `json:"active"`      // the device was seen recently even though its preference wasn't updated
+	Checked    int  `json:"checked"`     // tokens sent a dry run push
+	Alive      int  `json:"alive"`       // tokens the provider confirmed good
+	FormatOnly int  `json:"format_only"` // tokens that only passed a format check, apns has no dry run
+	Skipped    int  `json:"skipped"`     // checked recently, or the check couldn't tell
+
+	Dead    []string `json:"dead"`    // tokens the check found dead
+	Expired []string `json:"expired"` // not seen or updated within config.DeviceExpireAfter
+	Deleted int      `json:"deleted"`
+	Done    bool     `json:"done"` // the scan reached the end and starts over next time
+}
+
+// prune a batch of stale devices. a device is stale once neither it nor its preference has been seen or updated
+// within config.DeviceStaleAfter. stale tokens get a dry run push, which fcm answers for real, and the dead ones
+// are deleted. apns has no dry run, so ios tokens are only checked for their format and otherwise wait out
+// config.DeviceExpireAfter, after which any device is deleted unchecked.
+//
+// a scan keeps the stale cutoff it started with until it reaches the end, so its cursor always resumes the same
+// query. a dry run reports without deleting anything, and moves on through a scan of its own so successive dry runs
+// cover every device without touching where the real prune is.
+func PruneDevices(context appengine.Context, dryRun bool) (*PruneReport, error) {
+	report := &PruneReport{DryRun: dryRun, Dead: []string{}, Expired: []string{}}
+
+	state, err := db.GetDevicePruneState(context, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if state.Cursor == "" || state.StaleBefore.IsZero() {
+		state.Cursor = ""
+		state.StaleBefore = now.Add(-config.DeviceStaleAfter)
+	}
+	staleBefore := state.StaleBefore
+	expireBefore := now.Add(-config.DeviceExpireAfter)
+
+	preferences, next, err := db.StalePreferences(context, staleBefore, state.Cursor, config.DevicePruneBatch)
+	if err != nil {
+		return nil, err
+	}
+	report.Scanned = len(preferences)
+	report.Done = next == ""
+
+	tokens := make([]string, len(preferences))
+	for i := range preferences {
+		tokens[i] = preferences[i].GCMRegistrationId
+	}
+	devices, err := db.GetDevices(context, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	check := map[string][]string{}
+	platforms := map[string]string{} // every scanned token that isn't expired
+	for _, preference := range preferences {
+		token := preference.GCMRegistrationId
+		seen := preference.LastUpdated
+
+		device, ok := devices[token]
+		if ok && device.LastSeen.After(seen) {
+			seen = device.LastSeen
+		}
+
+		switch {
+		case seen.Before(expireBefore):
+			expired = append(expired, token)
+			continue
+		case seen.After(staleBefore):
+			report.Active++
+		case ok && device.Checked.After(staleBefore):
+			report.Skipped++
+		default:
+			check[preference.DevicePlatform()] = append(check[preference.DevicePlatform()], token)
+		}
+		platforms[token] = preference.DevicePlatform()
+	}
+
+	dead, alive := checkTokens(context, check, report)
+
+	// devices that never subscribed have no preference to find them by
+	orphans, err := db.StaleDevices(context, expireBefore, config.DevicePruneBatch)
+	if err != nil {
+		return nil, err
+	}
+	orphanTokens := make([]string, len(orphans))
+	for i := range orphans {
+		orphanTokens[i] = orphans[i].Token
+	}
+	orphanPreferences, err := db.GetNotificationPreferences(context, orphanTokens)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range orphanTokens {
+		preference, ok := orphanPreferences[token]
+		if ok && !preference.LastUpdated.Before(expireBefore) {
+			continue
+		}
+		// stale preferences in this batch were already sorted out above
+		if _, scanned := platforms[token]; scanned || (ok && containsToken(expired, token)) {
+			continue
+		}
+		expired = append(expired, token)
+	}
+
+	report.Dead = sample(dead)
+	report.Expired = sample(expired)
+	report.Deleted = len(dead) + len(expired)
+
+	if !dryRun {
+		if err := db.DeleteDevices(context, append(dead, expired...)); err != nil {
+			return nil, err
+		}
+
+		if len(alive) > 0 {
+			if err := db.MarkDevicesChecked(context, alive, platforms); err != nil {
+				context.Errorf("MarkDevicesChecked: %v", err)
+			}
+		}
+	}
+
+	state.Cursor = next
+	if report.Done {
+		state.StaleBefore = time.Time{}
+	}
+	if err := db.PutDevicePruneState(context, dryRun, state); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// send tokens a dry run push and sort them into dead and alive. tokens the provider couldn't answer for, or only
+// checked the format of, are left for next time.
+func checkTokens(context appengine.Context, tokens map[string][]string, report *PruneReport) ([]string, []string) {
+	var dead, alive []string
+	if len(tokens) == 0 {
+		return dead, alive
+	}
+
+	providers := providers(context)
+	message := &push.Message{
+		Data:     map[string]interface{}{"action": "check"},
+		Priority: push.PriorityNormal,
+		DryRun:   true,
+	}
+
+	for platform, platformTokens := range tokens {
+		provider, ok := providers[platform]
+		if !ok {
+			report.Skipped += len(platformTokens)
+			continue
+		}
+
+		size := provider.MaxBatch()
+		for off := 0; off < len(platformTokens); off += size {
+			max := off + size
+			if max > len(platformTokens) {
+				max = len(platformTokens)
+			}
+
+			results, err := provider.Send(message, platformTokens[off:max])
+			if err != nil {
+				context.Errorf("Prune check error %v (%v-%v): %v", platform, off, max, err)
+				report.Skipped += max - off
+				continue
+			}
+			for _, result := range results {
+				if !result.FormatOnly {
+					report.Checked++
+				}
+
+				switch {
+				case result.Dead():
+					dead = append(dead, result.Token)
+				case result.FormatOnly:
+					// not confirmed, so not marked checked either
+					report.FormatOnly++
+				case result.Error == "":
+					alive = append(alive, result.Token)
+					report.Alive++
+				default:
+					report.Skipped++
+				}
+			}
+		}
+	}
+	return dead, alive
+}
+
+func sample(tokens []string) []string {
+	if len(tokens) > pruneReportTokens {
+		return tokens[:pruneReportTokens]
+	}
+	if tokens == nil {
+		return []string{}
+	}
+	return tokens
+}
+
+func containsToken(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
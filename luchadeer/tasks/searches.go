@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tasks
+
+import (
+	"appengine"
+	"appengine/memcache"
+	"appengine/taskqueue"
+	"crypto/sha1"
+	"fmt"
+	"luchadeer/config"
+	"luchadeer/db"
+	"luchadeer/search"
+	"net/http"
+	"strconv"
+)
+
+const FLUSH_SEARCH_COUNT_URL = "/task/flush_search_count"
+
+// queries can be longer than a memcache key, so the key is a hash
+func searchCountKey(query string) string {
+	return fmt.Sprintf("search-count-%x", sha1.Sum([]byte(search.Normalize(query))))
+}
+
+// count a search towards the popular searches without touching the datastore. the first search for a query since
+// its last flush queues a task to add the count up config.SearchCountFlushInterval later, so a popular query costs
+// one transaction per interval instead of one per search.
+func CountSearch(context appengine.Context, query string) {
+	key := searchCountKey(query)
+	count, err := memcache.Increment(context, key, 1, 0)
+	if err != nil {
+		context.Errorf("memcache error: %v", err)
+		return
+	}
+	if count != 1 {
+		return
+	}
+
+	if err := queueSearchFlush(context, query); err != nil {
+		context.Errorf("Couldn't queue search count flush for %v: %v", query, err)
+		// start over so the next search queues one
+		memcache.Delete(context, key)
+	}
+}
+
+func queueSearchFlush(context appengine.Context, query string) error {
+	task := taskqueue.NewPOSTTask(FLUSH_SEARCH_COUNT_URL, map[string][]string{"query": {query}})
+	task.Delay = config.SearchCountFlushInterval
+	_, err := taskqueue.Add(context, task, "")
+	return err
+}
+
+// add what memcache counted for a query to the stored count. searches counted while it ran are left in memcache
+// for another flush.
+func flushSearchCount(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	query := r.FormValue("query")
+	key := searchCountKey(query)
+
+	item, err := memcache.Get(context, key)
+	if err == memcache.ErrCacheMiss {
+		// evicted, the count is lost
+		return
+	} else if err != nil {
+		context.Errorf("memcache error: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	count, err := strconv.ParseInt(string(item.Value), 10, 64)
+	if err != nil || count < 1 {
+		context.Errorf("Bad search count for %v: %q", query, item.Value)
+		memcache.Delete(context, key)
+		return
+	}
+
+	if err := db.RecordSearch(context, query, count); err != nil {
+		context.Errorf("RecordSearch: %v", err)
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	left, err := memcache.Increment(context, key, -count, 0)
+	if err != nil {
+		context.Errorf("memcache error: %v", err)
+		return
+	}
+	if left > 0 {
+		if err := queueSearchFlush(context, query); err != nil {
+			context.Errorf("Couldn't queue search count flush for %v: %v", query, err)
+		}
+	}
+}
@@ -32,22 +32,104 @@ package tasks
 
 import (
 	"appengine"
+	"appengine/socket"
 	"appengine/taskqueue"
 	"appengine/urlfetch"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/http2"
+	"luchadeer/apns"
+	"luchadeer/categories"
+	"luchadeer/client"
 	"luchadeer/config"
 	"luchadeer/db"
+	"luchadeer/flags"
 	"luchadeer/gcm"
 	"luchadeer/giantbomb"
+	"luchadeer/push"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 const PUSH_ALERTS_FOR_VIDEO_URL = "/task/push_alerts_for_video"
 const PUSH_ALERT_FOR_CHAT_URL = "/task/push_alert_for_chat"
+const PUSH_REMOVAL_FOR_VIDEO_URL = "/task/push_removal_for_video"
+const PUSH_RETRY_URL = "/task/push_retry"
+
+// most tokens carried by one retry task, to stay well under the task size limit
+const retryBatch = 250
 
 func Init() {
 	http.HandleFunc(PUSH_ALERTS_FOR_VIDEO_URL, pushAlertsForVideo)
 	http.HandleFunc(PUSH_ALERT_FOR_CHAT_URL, pushAlertForChat)
+	http.HandleFunc(PUSH_REMOVAL_FOR_VIDEO_URL, pushRemovalForVideo)
+	http.HandleFunc(PUSH_RETRY_URL, pushRetry)
+	http.HandleFunc(PUSH_WALK_URL, pushWalk)
+	http.HandleFunc(PUSH_PAGE_URL, pushPage)
+	http.HandleFunc(BACKFILL_VIDEOS_URL, backfillVideos)
+	http.HandleFunc(FLUSH_SEARCH_COUNT_URL, flushSearchCount)
+}
+
+func newGCM(context appengine.Context) (*gcm.GCM, error) {
+	account, err := gcm.ParseServiceAccount([]byte(config.FCMServiceAccount))
+	if err != nil {
+		return nil, err
+	}
+	return gcm.NewGCM(account, urlfetch.Client(context))
+}
+
+// a provider for every platform we have credentials for
+func providers(context appengine.Context) map[string]push.Provider {
+	providers := map[string]push.Provider{}
+
+	if config.FCMServiceAccount != "" {
+		g, err := newGCM(context)
+		if err != nil {
+			context.Errorf("NewGCM: %v", err)
+		} else {
+			providers[client.PlatformAndroid] = push.NewGCMProvider(g, config.AndroidPackageName)
+		}
+	}
+
+	if config.APNsPrivateKey != "" {
+		host := apns.DevelopmentHost
+		if config.APNsProduction {
+			host = apns.ProductionHost
+		}
+		a, err := apns.NewAPNs(host, config.APNsKeyId, config.APNsTeamId, config.APNsTopic, []byte(config.APNsPrivateKey), apnsClient(context))
+		if err != nil {
+			context.Errorf("NewAPNs: %v", err)
+		} else {
+			providers[client.PlatformIOS] = push.NewAPNsProvider(a)
+		}
+	}
+
+	return providers
+}
+
+// apns only speaks http/2, which urlfetch can't do, so go through the sockets api with an http2 transport over
+// our own tls connection.
+func apnsClient(context appengine.Context) *http.Client {
+	return &http.Client{
+		Transport: &http2.Transport{
+			DialTLS: func(network, addr string, tlsConfig *tls.Config) (net.Conn, error) {
+				conn, err := socket.Dial(context, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, tlsConfig)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		},
+	}
 }
 
 func PushAlertsForVideo(context appengine.Context, video *giantbomb.Video) {
@@ -59,91 +141,374 @@ func PushAlertsForVideo(context appengine.Context, video *giantbomb.Video) {
 			"video_id":   {strconv.FormatInt(video.Id, 10)},
 		},
 	)
+	// named so a video found by overlapping pulls is only queued once
+	task.Name = "push-" + videoNotification(video.Id)
 
-	if _, err := taskqueue.Add(context, task, ""); err != nil {
+	if _, err := taskqueue.Add(context, task, ""); err != nil && err != taskqueue.ErrTaskAlreadyAdded {
 		context.Errorf("PushAlertsForVideo: %v", err.Error())
 	}
 }
 
+// notification keys, which name the tasks that push them and key the delivery ledger
+func videoNotification(id int64) string {
+	return "video-" + strconv.FormatInt(id, 10)
+}
+
+func removalNotification(id int64) string {
+	return "removal-" + strconv.FormatInt(id, 10)
+}
+
+// the same title can come back once the 24 hours are up, so the time it was seen is part of the key
+func chatNotification(chat *giantbomb.Chat) string {
+	return fmt.Sprintf("chat-%x-%d", sha1.Sum([]byte(chat.Title)), chat.FirstSeen.Unix())
+}
+
 func pushAlertsForVideo(w http.ResponseWriter, r *http.Request) {
-	if config.GCMApiKey == "" {
+	context := appengine.NewContext(r)
+
+	providers := providers(context)
+	if len(providers) == 0 {
 		return
 	}
 
-	context := appengine.NewContext(r)
-
 	videoType := r.FormValue("video_type")
 	videoName := r.FormValue("video_name")
 	videoId := r.FormValue("video_id")
 
-	registrationIds := registrationIdsForVideoType(context, videoType)
-	if registrationIds == nil {
-		context.Infof("No registrationIds for %v", videoType)
+	id, err := strconv.ParseInt(videoId, 10, 64)
+	if err != nil {
+		context.Errorf("Bad video_id %v: %v", videoId, err)
 		return
 	}
 
-	push := gcm.NewGCM(config.GCMApiKey, urlfetch.Client(context))
+	err = fanOut(context, videoNotification(id), videoType, &push.Message{
+		Data:  map[string]interface{}{"video_name": videoName, "video_id": videoId, "video_type": videoType},
+		Alert: &push.Alert{Title: videoAlertTitle(videoType), Body: videoName},
+		// a burst of new videos shows up as the latest one rather than a stack
+		CollapseKey: "new_video",
+		TimeToLive:  config.VideoAlertTTL,
+		Priority:    push.PriorityHigh,
+		DryRun:      config.PushDryRun,
+	})
+	if err != nil {
+		context.Errorf("Couldn't push new video %v: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// the video type names the kind of video, e.g. Quick Looks
+func videoAlertTitle(videoType string) string {
+	if videoType == "" {
+		return "New video"
+	}
+	return "New in " + videoType
+}
+
+// tell subscribers a video they may have been alerted about is gone.
+func PushRemovalForVideo(context appengine.Context, video *giantbomb.Video) {
+	task := taskqueue.NewPOSTTask(
+		PUSH_REMOVAL_FOR_VIDEO_URL,
+		map[string][]string{
+			"video_type": {video.VideoType},
+			"video_id":   {strconv.FormatInt(video.Id, 10)},
+		},
+	)
+	task.Name = "push-" + removalNotification(video.Id)
 
-	pushChunked(context, push, registrationIds, map[string]interface{}{"video_name": videoName, "video_id": videoId, "video_type": videoType})
+	if _, err := taskqueue.Add(context, task, ""); err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+		context.Errorf("PushRemovalForVideo: %v", err.Error())
+	}
 }
 
-func registrationIdsForVideoType(context appengine.Context, videoType string) []string {
-	preferences, err := db.NotificationSubscriptions(context, videoType)
+func pushRemovalForVideo(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	providers := providers(context)
+	if len(providers) == 0 {
+		return
+	}
+
+	videoType := r.FormValue("video_type")
+	videoId := r.FormValue("video_id")
+
+	id, err := strconv.ParseInt(videoId, 10, 64)
 	if err != nil {
-		context.Errorf("Couldn't fetch subscriptions for push: %v", err)
-		return nil
+		context.Errorf("Bad video_id %v: %v", videoId, err)
+		return
 	}
 
-	registrationIds := []string{}
+	// every removal has to reach the device, so nothing collapses, and there's no hurry
+	err = fanOut(context, removalNotification(id), videoType, &push.Message{
+		Data:       map[string]interface{}{"action": "video_removed", "video_id": videoId, "video_type": videoType},
+		TimeToLive: config.VideoAlertTTL,
+		Priority:   push.PriorityNormal,
+		DryRun:     config.PushDryRun,
+	})
+	if err != nil {
+		context.Errorf("Couldn't push removal of video %v: %v", id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// the tokens of preferences the push flag is on for, grouped by platform. devices, which may be missing some
+// tokens, let the flag target app versions.
+func tokensFor(set *flags.Set, preferences []db.NotificationPreference, devices map[string]*db.Device) map[string][]string {
+	tokens := map[string][]string{}
 	for _, preference := range preferences {
-		registrationIds = append(registrationIds, preference.GCMRegistrationId)
+		platform := preference.DevicePlatform()
+		target := &flags.Target{Device: preference.GCMRegistrationId, Platform: platform}
+		if device, ok := devices[preference.GCMRegistrationId]; ok && device.AppVersion != "" {
+			target.Version, _ = client.ParseVersion(device.AppVersion)
+		}
+		if set.Enabled(flags.PushNotifications, target) {
+			tokens[platform] = append(tokens[platform], preference.GCMRegistrationId)
+		}
 	}
-	return registrationIds
+	return tokens
 }
 
-func pushChunked(context appengine.Context, push *gcm.GCM, registrationIds []string, data map[string]interface{}) {
-	for off := 0; off < len(registrationIds); off += 1000 {
-		max := off + 1000
-		if max > len(registrationIds) {
-			max = len(registrationIds) - off
+// send notification to every token it hasn't reached yet, then queue a retry for the ones that failed on the
+// provider's end
+func pushAttempt(context appengine.Context, notification string, providers map[string]push.Provider, tokens map[string][]string, message *push.Message, attempt int) push.Counts {
+	counts := push.Counts{Errors: map[string]int{}}
+	for platform, platformTokens := range tokens {
+		provider, ok := providers[platform]
+		if !ok {
+			context.Infof("No push provider for %v, skipping %v devices", platform, len(platformTokens))
+			continue
 		}
-		pushResult, err := push.Send(data, registrationIds[off:max])
-		if err != nil {
-			context.Errorf("Push error (%v-%v): %v", off, max, err)
+
+		// dry runs deliver nothing, so they neither check nor fill the ledger
+		if !message.DryRun {
+			undelivered, err := db.UndeliveredTokens(context, notification, platformTokens)
+			if err != nil {
+				// better to wait for a retry, which checks again, than risk pushing twice
+				context.Errorf("Couldn't check deliveries of %v for %v devices: %v", notification, platform, err)
+				queueRetry(context, notification, platform, platformTokens, message, attempt, 0)
+				counts.Retried += len(platformTokens)
+				continue
+			}
+			if skipped := len(platformTokens) - len(undelivered); skipped > 0 {
+				context.Infof("Skipping %v %v devices %v already reached", skipped, platform, notification)
+			}
+			platformTokens = undelivered
+		}
+
+		total := push.Counts{Errors: map[string]int{}}
+		var retry []string
+		var wait time.Duration
+
+		size := provider.MaxBatch()
+		for off := 0; off < len(platformTokens); off += size {
+			max := off + size
+			if max > len(platformTokens) {
+				max = len(platformTokens)
+			}
+			results, err := provider.Send(message, platformTokens[off:max])
+			if err != nil {
+				context.Errorf("Push error %v (%v-%v): %v", platform, off, max, err)
+				retry = append(retry, platformTokens[off:max]...)
+				continue
+			}
+			total.Add(processResults(context, results))
+
+			if !message.DryRun {
+				var delivered []string
+				for _, result := range results {
+					if result.Error == "" {
+						delivered = append(delivered, result.Token)
+					}
+				}
+				if err := db.RecordPushDeliveries(context, notification, delivered); err != nil {
+					context.Errorf("Couldn't record deliveries of %v: %v", notification, err)
+				}
+			}
+
+			for _, result := range results {
+				if result.Retryable() {
+					retry = append(retry, result.Token)
+					if result.RetryAfter > wait {
+						wait = result.RetryAfter
+					}
+				}
+			}
+		}
+		context.Infof("Push result %v %v attempt %v (%v devices): %+v", notification, platform, attempt, len(platformTokens), total)
+
+		if len(retry) > 0 {
+			queueRetry(context, notification, platform, retry, message, attempt, wait)
+			total.Retried += len(retry)
+		}
+		counts.Add(total)
+	}
+	return counts
+}
+
+// doubles from PushRetryBaseDelay each attempt, but never shorter than the provider asked for
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	delay := config.PushRetryBaseDelay
+	for i := 1; i < attempt && delay < config.PushRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > config.PushRetryMaxDelay {
+		delay = config.PushRetryMaxDelay
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay
+}
+
+func queueRetry(context appengine.Context, notification, platform string, tokens []string, message *push.Message, attempt int, retryAfter time.Duration) {
+	if attempt >= config.PushMaxAttempts {
+		context.Errorf("Giving up on %v %v devices after %v attempts", len(tokens), platform, attempt)
+		return
+	}
+
+	delay := retryDelay(attempt, retryAfter)
+
+	// the message shouldn't outlive its original time to live by waiting in the queue
+	retried := *message
+	if retried.TimeToLive > 0 {
+		if retried.TimeToLive <= delay {
+			context.Infof("Dropping retry for %v %v devices, it would expire first", len(tokens), platform)
+			return
+		}
+		retried.TimeToLive -= delay
+	}
+
+	marshalled, err := json.Marshal(&retried)
+	if err != nil {
+		context.Errorf("Couldn't marshal push for retry: %v", err)
+		return
+	}
+
+	for off := 0; off < len(tokens); off += retryBatch {
+		max := off + retryBatch
+		if max > len(tokens) {
+			max = len(tokens)
+		}
+
+		task := taskqueue.NewPOSTTask(
+			PUSH_RETRY_URL,
+			map[string][]string{
+				"notification": {notification},
+				"platform":     {platform},
+				"attempt":      {strconv.Itoa(attempt + 1)},
+				"message":      {string(marshalled)},
+				"token":        tokens[off:max],
+			},
+		)
+		task.Name = retryTaskName(notification, platform, attempt+1, off, tokens[off:max])
+		task.Delay = delay
+
+		if _, err := taskqueue.Add(context, task, ""); err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+			context.Errorf("Couldn't queue push retry for %v %v devices: %v", max-off, platform, err)
 		}
-		context.Infof("Push result (%v-%v): %v", off, max, pushResult)
 	}
+	context.Infof("Retrying %v %v devices in %v (attempt %v)", len(tokens), platform, delay, attempt+1)
 }
 
-func PushAlertForChat(context appengine.Context, title string) {
+// retry tasks are named after the notification, platform, attempt and chunk, so a page or retry task that runs
+// twice can't queue the same retry twice. several pages and retries of one notification queue chunks at the same
+// offset, so the name also carries a hash of the chunk's tokens to keep them apart.
+func retryTaskName(notification, platform string, attempt, off int, tokens []string) string {
+	hash := sha1.New()
+	for _, token := range tokens {
+		hash.Write([]byte(token))
+		hash.Write([]byte{0})
+	}
+	return fmt.Sprintf("push-retry-%s-%s-%d-%d-%x", notification, platform, attempt, off, hash.Sum(nil)[:8])
+}
+
+func pushRetry(w http.ResponseWriter, r *http.Request) {
+	context := appengine.NewContext(r)
+
+	providers := providers(context)
+	if len(providers) == 0 {
+		return
+	}
+
+	r.ParseForm()
+	platform := r.FormValue("platform")
+	attempt, _ := strconv.Atoi(r.FormValue("attempt"))
+	tokens := r.Form["token"]
+
+	var message push.Message
+	if err := json.Unmarshal([]byte(r.FormValue("message")), &message); err != nil {
+		context.Errorf("Couldn't unmarshal push retry: %v", err)
+		return
+	}
+
+	pushAttempt(context, r.FormValue("notification"), providers, map[string][]string{platform: tokens}, &message, attempt)
+}
+
+// forget dead tokens and move preferences over to canonical ones
+func processResults(context appengine.Context, results []push.Result) push.Counts {
+	counts := push.Count(results)
+
+	var dead []string
+	for _, result := range results {
+		if result.Dead() {
+			dead = append(dead, result.Token)
+			continue
+		}
+		if result.CanonicalToken != "" && result.CanonicalToken != result.Token {
+			if err := db.ReplaceNotificationToken(context, result.Token, result.CanonicalToken); err != nil {
+				context.Errorf("Couldn't replace token with canonical: %v", err)
+				continue
+			}
+			counts.Replaced++
+		}
+	}
+
+	if len(dead) > 0 {
+		if err := db.DeleteDevices(context, dead); err != nil {
+			context.Errorf("Couldn't delete dead registrations: %v", err)
+		} else {
+			counts.Removed += len(dead)
+		}
+	}
+
+	return counts
+}
+
+func PushAlertForChat(context appengine.Context, chat *giantbomb.Chat) {
+	notification := chatNotification(chat)
 	task := taskqueue.NewPOSTTask(
 		PUSH_ALERT_FOR_CHAT_URL,
 		map[string][]string{
-			"title": {title},
+			"title":        {chat.Title},
+			"notification": {notification},
 		},
 	)
+	task.Name = "push-" + notification
 
-	if _, err := taskqueue.Add(context, task, ""); err != nil {
+	if _, err := taskqueue.Add(context, task, ""); err != nil && err != taskqueue.ErrTaskAlreadyAdded {
 		context.Errorf("PushAlertForChat: %v", err.Error())
 	}
 }
 
 func pushAlertForChat(w http.ResponseWriter, r *http.Request) {
-	if config.GCMApiKey == "" {
-		return
-	}
-
 	context := appengine.NewContext(r)
 
-	registrationIds := registrationIdsForVideoType(context, "live")
-	if registrationIds == nil {
-		context.Infof("No registrationIds for live")
+	providers := providers(context)
+	if len(providers) == 0 {
 		return
 	}
 
 	title := r.FormValue("title")
 
-	push := gcm.NewGCM(config.GCMApiKey, urlfetch.Client(context))
-
-	pushChunked(context, push, registrationIds, map[string]interface{}{"video_name": title, "video_id": 0, "video_type": "live"})
+	err := fanOut(context, r.FormValue("notification"), categories.Live, &push.Message{
+		Data:        map[string]interface{}{"video_name": title, "video_id": 0, "video_type": "live"},
+		Alert:       &push.Alert{Title: "Live on Giant Bomb", Body: title},
+		CollapseKey: "live",
+		TimeToLive:  config.LiveAlertTTL,
+		Priority:    push.PriorityHigh,
+		DryRun:      config.PushDryRun,
+	})
+	if err != nil {
+		context.Errorf("Couldn't push live alert %v: %v", title, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,72 @@
+/*
+ * Copyright (c) 2014, David Forsythe
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions are met:
+ *
+ *  Redistributions of source code must retain the above copyright notice, this
+ *   list of conditions and the following disclaimer.
+ *
+ *  Redistributions in binary form must reproduce the above copyright notice,
+ *   this list of conditions and the following disclaimer in the documentation
+ *   and/or other materials provided with the distribution.
+ *
+ *  Neither the name of Luchadeer nor the names of its
+ *   contributors may be used to endorse or promote products derived from
+ *   this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+ * AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+ * CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+ * OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+ * OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package tasks
+
+import (
+	"luchadeer/config"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	base := config.PushRetryBaseDelay
+	max := config.PushRetryMaxDelay
+
+	tests := []struct {
+		attempt    int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{1, 0, base},
+		{2, 0, base * 2},
+		{3, 0, base * 4},
+		{4, 0, base * 8},
+		{100, 0, max},
+		// the provider's wait wins when it's longer, even past the cap
+		{1, base * 3, base * 3},
+		{3, base, base * 4},
+		{100, max * 2, max * 2},
+	}
+
+	for _, test := range tests {
+		if got := retryDelay(test.attempt, test.retryAfter); got != test.want {
+			t.Errorf("retryDelay(%v, %v) = %v, want %v", test.attempt, test.retryAfter, got, test.want)
+		}
+	}
+
+	// never shrinks from one attempt to the next, and never passes the cap on its own
+	for attempt := 1; attempt < 30; attempt++ {
+		delay, next := retryDelay(attempt, 0), retryDelay(attempt+1, 0)
+		if next < delay || next > max {
+			t.Errorf("retryDelay(%v) = %v after %v", attempt+1, next, delay)
+		}
+	}
+}